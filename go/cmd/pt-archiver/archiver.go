@@ -0,0 +1,1473 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   The archiver nibbles rows out of the --source table, copies them to
+   --dest and deletes them from --source, one chunk of --limit rows at a
+   time. It follows the logic of the main loop of the Perl pt-archiver.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/y-trudeau/go-toolkit/go/pkg/debug"
+	"github.com/y-trudeau/go-toolkit/go/pkg/dsn"
+	"github.com/y-trudeau/go-toolkit/go/pkg/quoter"
+	"github.com/y-trudeau/go-toolkit/go/pkg/tablenibbler"
+	"github.com/y-trudeau/go-toolkit/go/pkg/tableparser"
+
+	"go-toolkit/pkg/archiverplugin"
+	"go-toolkit/pkg/checkpoint"
+	"go-toolkit/pkg/chunksizer"
+	"go-toolkit/pkg/colcheck"
+	"go-toolkit/pkg/filesink"
+	"go-toolkit/pkg/outfile"
+	"go-toolkit/pkg/retry"
+	"go-toolkit/pkg/sentinel"
+	"go-toolkit/pkg/version"
+)
+
+type Archiver struct {
+	config     *Configuration
+	id         int // worker number, 0 without --workers
+	src        dsn.Dsn
+	dst        dsn.Dsn
+	hasDest    bool
+	srcName    string // backticked db.table of the source
+	dstName    string // backticked db.table of the destination
+	srcTbl     tableparser.TableInfo
+	dstTbl     tableparser.TableInfo
+	index      string
+	asc        tablenibbler.AscStmt
+	del        tablenibbler.DelStmt
+	ins        tablenibbler.InsStmt
+	selCols    []string // columns returned by the SELECT, asc and del slices point in it
+	outCols    int      // leading columns of selCols requested by the user, written to --file
+	limit      int
+	sleep      time.Duration // time to sleep between fetches
+	sizer      *chunksizer.Sizer
+	selectTime time.Duration // time of the last SELECT, for --chunk-time
+	insSql     string
+	delSql     string
+	bulkSql    string // LOAD DATA statement of --bulk-insert
+	verifySql  string // SELECT of --verify-dest, reading the archived columns of a row in dest with the DELETE key
+	readerName string // reader handler of the LOAD DATA statement
+	bulkBuf    bytes.Buffer
+	sink       *filesink.Sink
+	fileRows   [][]sql.NullString // rows of the current transaction, written to --file at commit
+	pending    rowCounts          // rows of the current transaction, added to the run counters at commit
+	throttle   *sharedThrottle
+	sentinel   *sentinel.Sentinel
+	checkpoint checkpoint.Store
+	txnLast    []sql.NullString // last row of the current transaction, saved in the checkpoint at commit
+	resume     []any            // boundary loaded by --resume, bound to the first SELECT
+	plugin     archiverplugin.Plugin
+	archived   [][]sql.NullString // rows of the current chunk archived, for --bulk-insert
+	children   []childTable       // tables referencing the source with a foreign key
+	srcTx      *sql.Tx
+	dstTx      *sql.Tx
+	txnRows    int // rows archived in the current transaction
+	policy     retry.Policy
+	done       int  // rows of the current chunk already committed
+	doneInsert bool // the row done is already inserted in dest without a transaction
+	carried    int  // rows of previous chunks in the current transaction
+	lastRow    []sql.NullString
+	autoIncMax string // upper bound clause of the auto-increment safety check
+	lock       string // locking clause of the SELECT, --for-update or --share-lock
+	run        *runControl
+	ctx        context.Context // canceled to abort the running statements
+	cancel     context.CancelFunc
+	stop       chan struct{} // closed by halt
+	stopOnce   sync.Once
+	signal     os.Signal            // signal received, set before stop is closed
+	rangeAsc   tablenibbler.AscStmt // boundaries of the --workers ranges, on the first index column
+	lower      []any                // values of the lower boundary of the range, nil for the first worker
+	upper      []any                // values of the upper boundary of the range, nil for the last worker
+}
+
+// rawValues makes sure the driver returns values as they are stored, the
+// rows are written back to MySQL or to a file without any conversion.
+func rawValues(d *dsn.Dsn) {
+	d.Extra = strings.ReplaceAll(d.Extra, "parseTime=true", "parseTime=false")
+}
+
+// inheritDsn fills the values missing from the --dest DSN with the ones
+// of the --source DSN, like the Perl tool does.
+func inheritDsn(dst *dsn.Dsn, src dsn.Dsn) {
+	if len(dst.Host) == 0 && len(dst.Socket) == 0 {
+		dst.Host = src.Host
+		dst.Port = src.Port
+		dst.Socket = src.Socket
+	}
+	if len(dst.User) == 0 {
+		dst.User = src.User
+		dst.Password = src.Password
+	}
+	if len(dst.Database) == 0 {
+		dst.Database = src.Database
+	}
+	if len(dst.Table) == 0 {
+		dst.Table = src.Table
+	}
+}
+
+// getTable returns the parsed definition of the table of a DSN
+func getTable(d *dsn.Dsn) (tableparser.TableInfo, error) {
+	dbh, err := d.Getconn()
+	if err != nil {
+		return tableparser.TableInfo{}, err
+	}
+	exists, err := tableparser.Checktable(dbh, d.Database, d.Table)
+	if err != nil {
+		return tableparser.TableInfo{}, err
+	}
+	if !exists {
+		return tableparser.TableInfo{}, fmt.Errorf("Table %v does not exist", quoter.Backtick([]string{d.Database, d.Table}))
+	}
+	ddl, err := tableparser.GetCreateTable(dbh, d.Database, d.Table)
+	if err != nil {
+		return tableparser.TableInfo{}, err
+	}
+	return tableparser.Parse(ddl)
+}
+
+// bindArgs returns the values of row at the ordinals of slice, ready to be
+// bound to the ? placeholders of a statement.
+func bindArgs(row []sql.NullString, slice []int) []any {
+	args := make([]any, len(slice))
+	for i, ord := range slice {
+		args[i] = row[ord]
+	}
+	return args
+}
+
+// backtickList returns the backticked columns separated by commas
+func backtickList(cols []string) string {
+	quoted := make([]string, len(cols))
+	for i, col := range cols {
+		quoted[i] = quoter.Backtick([]string{col})
+	}
+	return strings.Join(quoted, ",")
+}
+
+// NewArchiver connects to --source and --dest and generates the statements
+// used to nibble the table. The run controller is shared by the workers.
+func NewArchiver(config *Configuration, id int, run *runControl) (*Archiver, error) {
+	a := &Archiver{config: config, id: id, limit: config.Limit, sleep: config.SleepTime, run: run}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	a.stop = make(chan struct{})
+	a.policy = retry.Policy{Retries: config.Retries, Backoff: time.Second}
+	if a.limit < 1 {
+		a.limit = 1
+	}
+	if config.ChunkTime > 0 {
+		a.sizer = &chunksizer.Sizer{Target: config.ChunkTime, Min: config.ChunkSizeMin, Max: config.ChunkSizeMax}
+	}
+
+	if err := a.src.Parse(config.Source); err != nil {
+		return nil, fmt.Errorf("Unable to parse the source DSN: %v", err)
+	}
+	rawValues(&a.src)
+	a.srcName = quoter.Backtick([]string{a.src.Database, a.src.Table})
+
+	var err error
+	a.srcTbl, err = getTable(&a.src)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get the source table: %v", err)
+	}
+
+	if config.ForUpdate || config.ShareLock {
+		var v string
+		if err := a.src.Dbh.QueryRow("SELECT @@version").Scan(&v); err != nil {
+			return nil, fmt.Errorf("Unable to get the source version: %v", err)
+		}
+		if a.lock, err = lockClause(config, v); err != nil {
+			return nil, err
+		}
+		debug.Printvar("Locking clause", a.lock)
+	}
+
+	if len(config.Dest) > 0 {
+		if err := a.dst.Parse(config.Dest); err != nil {
+			return nil, fmt.Errorf("Unable to parse the dest DSN: %v", err)
+		}
+		inheritDsn(&a.dst, a.src)
+		rawValues(&a.dst)
+		a.hasDest = true
+		a.dstName = quoter.Backtick([]string{a.dst.Database, a.dst.Table})
+
+		a.dstTbl, err = getTable(&a.dst)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get the dest table: %v", err)
+		}
+		if config.InsertSelect {
+			if err := a.sameServer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if config.SkipFKChecks {
+		if _, err := a.src.Dbh.Exec("SET FOREIGN_KEY_CHECKS=0"); err != nil {
+			return nil, err
+		}
+		if a.hasDest {
+			if _, err := a.dst.Dbh.Exec("SET FOREIGN_KEY_CHECKS=0"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !config.NoDelete {
+		if a.children, err = findChildren(a.src); err != nil {
+			return nil, err
+		}
+		a.warnChildren()
+	}
+
+	if err := a.prepare(); err != nil {
+		return nil, err
+	}
+	if config.ArchiveChildren {
+		if err := a.prepareChildren(); err != nil {
+			return nil, err
+		}
+	}
+	// Nothing is created nor loaded, the plan is only printed
+	if config.DryRun {
+		return a, nil
+	}
+
+	if err := a.prepareCheckpoint(); err != nil {
+		return nil, err
+	}
+
+	if len(config.File) > 0 {
+		if err := a.openFile(config.File); err != nil {
+			return nil, err
+		}
+	}
+
+	a.prepareSentinel()
+
+	if len(config.Plugin) > 0 {
+		factory, err := archiverplugin.Load(config.Plugin)
+		if err != nil {
+			return nil, err
+		}
+		a.plugin, err = factory(archiverplugin.Table{
+			SourceDsn: config.Source,
+			Database:  a.src.Database,
+			Table:     a.src.Table,
+			DestDsn:   config.Dest,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create the plugin: %v", err)
+		}
+	}
+	return a, nil
+}
+
+// prepareCheckpoint opens the --checkpoint-file or --checkpoint-table store
+// and loads the boundary to start from with --resume.
+func (a *Archiver) prepareCheckpoint() error {
+	switch {
+	case len(a.config.CheckpointFile) > 0:
+		a.checkpoint = checkpoint.FileStore{File: a.config.CheckpointFile}
+	case len(a.config.CheckpointTable) > 0:
+		db, tbl := quoter.Splitunbacktick(a.config.CheckpointTable, a.src.Database)
+		store, err := checkpoint.NewTableStore(a.src.Dbh, db, tbl, a.srcName)
+		if err != nil {
+			return err
+		}
+		a.checkpoint = store
+	default:
+		return nil
+	}
+	if !a.config.Resume {
+		return nil
+	}
+
+	cp, found, err := a.checkpoint.Load()
+	if err != nil {
+		return err
+	}
+	if !found {
+		debug.Print("No checkpoint found, starting from the beginning of the index")
+		return nil
+	}
+	if err := cp.Matches(a.srcName, a.index, a.asc.Scols); err != nil {
+		return err
+	}
+	a.resume = cp.Args()
+	debug.PrintArray("Resuming after", a.asc.Scols, ", ")
+	return nil
+}
+
+// saveCheckpoint saves the boundary of the last row committed. When tx is
+// not nil, the --checkpoint-table row is written within it so it commits with
+// the deletes.
+func (a *Archiver) saveCheckpoint(tx *sql.Tx) error {
+	if a.checkpoint == nil || a.txnLast == nil {
+		return nil
+	}
+	vals := make([]sql.NullString, len(a.asc.Slice))
+	for i, ord := range a.asc.Slice {
+		vals[i] = a.txnLast[ord]
+	}
+	a.txnLast = nil
+	var err error
+	GenStats(a.config, "checkpoint", func() {
+		cp := checkpoint.New(a.srcName, a.index, a.asc.Scols, vals)
+		if ts, ok := a.checkpoint.(*checkpoint.TableStore); ok && tx != nil {
+			err = ts.SaveTx(tx, cp)
+		} else {
+			err = a.checkpoint.Save(cp)
+		}
+	})
+	return err
+}
+
+// prepareSentinel creates the controller of the --stop-sentinel and
+// --pause-sentinel files. The transaction is committed before pausing so
+// no lock is held while paused.
+func (a *Archiver) prepareSentinel() {
+	a.sentinel = &sentinel.Sentinel{
+		StopFile:  a.config.StopSentinel,
+		PauseFile: a.config.PauseSentinel,
+		Interval:  time.Duration(a.config.CheckTime) * time.Second,
+		Sleep:     a.pause,
+		Done:      a.stop,
+		OnPause:   a.commit,
+	}
+	// All the workers see the same files, only the first one logs
+	if !a.config.Quiet && a.id == 0 {
+		a.sentinel.Log = os.Stdout
+	}
+}
+
+// openFile prepares the --file sink, the file is opened by the first row
+// and the header is only written when the file is created.
+func (a *Archiver) openFile(name string) error {
+	a.sink = &filesink.Sink{
+		Template: name,
+		Database: a.src.Database,
+		Table:    a.src.Table,
+		Format:   a.config.OutputFormat,
+		MaxSize:  a.config.FileMaxSize,
+		Rotate:   a.config.FileRotate,
+	}
+	if a.config.Header {
+		a.sink.Header = a.selCols[:a.outCols]
+	}
+	return a.sink.Check()
+}
+
+// writeFile writes the rows of the current transaction to --file, flushed
+// unless --buffer. They are only written once committed, or about to be, so
+// the rows of a transaction rolled back and replayed are not duplicated.
+func (a *Archiver) writeFile() error {
+	if a.sink == nil || len(a.fileRows) == 0 {
+		return nil
+	}
+	var err error
+	GenStats(a.config, "print_file", func() {
+		err = a.sink.Write(a.fileRows)
+		if err == nil && !a.config.Buffer {
+			err = a.sink.Flush()
+		}
+	})
+	a.fileRows = a.fileRows[:0]
+	return err
+}
+
+// publish writes the rows committed without a transaction to --file and
+// adds them to the run counters.
+func (a *Archiver) publish() error {
+	if err := a.writeFile(); err != nil {
+		return err
+	}
+	a.run.add(a.pending)
+	a.pending = rowCounts{}
+	return nil
+}
+
+// syncFile flushes the rows written to --file and syncs it, the file is
+// rotated if needed.
+func (a *Archiver) syncFile() error {
+	if a.sink == nil {
+		return nil
+	}
+	var err error
+	GenStats(a.config, "file_sync", func() {
+		err = a.sink.Commit()
+	})
+	return err
+}
+
+// userCols returns the columns of --columns or --primary-key-only, nil
+// meaning all the columns.
+func (a *Archiver) userCols() ([]string, error) {
+	if a.config.PrimaryKeyOnly {
+		if !a.srcTbl.KeyExists("PRIMARY") {
+			return nil, fmt.Errorf("'primary-key-only' requires a primary key, table %v has none", a.srcName)
+		}
+		return a.srcTbl.KeyCols("PRIMARY"), nil
+	}
+	if len(a.config.Columns) == 0 {
+		return nil, nil
+	}
+	var cols []string
+	for _, col := range quoter.Deserializelist(a.config.Columns) {
+		col = strings.Trim(strings.TrimSpace(col), "`")
+		if !a.srcTbl.ColExists(col) {
+			return nil, fmt.Errorf("Column `%v` of 'columns' doesn't exist in table %v", col, a.srcName)
+		}
+		if !slices.Contains(cols, col) {
+			cols = append(cols, col)
+		}
+	}
+	return cols, nil
+}
+
+// prepare generates the SELECT, INSERT and DELETE statements
+func (a *Archiver) prepare() error {
+	if len(a.srcTbl.Sortindexes()) == 0 {
+		return fmt.Errorf("Cannot find an ascendable index in table %v", a.srcName)
+	}
+	a.index = a.srcTbl.Findbestindex("")
+
+	cols, err := a.userCols()
+	if err != nil {
+		return err
+	}
+	if a.config.InsertSelect {
+		return a.prepareInsertSelect(cols)
+	}
+	// The columns referenced by the child rows are fetched too
+	user := len(cols)
+	if user > 0 {
+		cols = appendMissing(cols, a.childParentCols())
+	}
+
+	// The index columns are appended to the user columns when missing
+	a.asc, err = tablenibbler.GenerateAscStmt(a.srcTbl, a.index, cols, a.config.AscendFirst, 0, true)
+	if err != nil {
+		return err
+	}
+
+	// The DELETE may need more columns than the SELECT, they are appended
+	// so the ordinals of the ascending slice remain valid.
+	a.del, err = tablenibbler.GenerateDelStmt(a.srcTbl, a.asc.Cols, a.index)
+	if err != nil {
+		return err
+	}
+	a.selCols = a.del.Cols
+	a.outCols = len(a.selCols)
+	if user > 0 {
+		a.outCols = user
+	}
+	debug.PrintArray("Columns selected", a.selCols, ", ")
+
+	if !a.config.NoSafeAutoInc {
+		if err := a.safeAutoInc(); err != nil {
+			return err
+		}
+	}
+
+	a.delSql = "DELETE FROM " + a.srcName + " WHERE " + a.del.Where
+	if !a.srcTbl.KeyIsUnique(a.del.Index) {
+		a.delSql = a.delSql + " LIMIT 1"
+	}
+	debug.Printvar("DELETE statement", a.delSql)
+
+	if a.hasDest {
+		if a.config.CheckColumns {
+			if err := a.checkColumns(a.selCols); err != nil {
+				return err
+			}
+		}
+		a.ins, err = tablenibbler.GenerateInsStmt(a.dstTbl, a.selCols)
+		if err != nil {
+			return err
+		}
+		a.insSql = a.insertVerb() + " INTO " + a.dstName + " (" + backtickList(a.ins.Cols) + ") VALUES (" +
+			strings.TrimRight(strings.Repeat("?,", len(a.ins.Cols)), ",") + ")"
+		debug.Printvar("INSERT statement", a.insSql)
+
+		if a.config.BulkInsert {
+			a.prepareBulkInsert()
+		}
+		if a.config.VerifyDest {
+			if err := a.prepareVerify(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// insertVerb returns the INSERT, INSERT IGNORE or REPLACE verb
+func (a *Archiver) insertVerb() string {
+	if a.config.Replace {
+		return "REPLACE"
+	} else if a.config.Ignore {
+		return "INSERT IGNORE"
+	}
+	return "INSERT"
+}
+
+// checkColumns compares the archived columns with the dest columns. The
+// differences that would lose or reject rows are an error, the others are
+// only reported, by the first worker.
+func (a *Archiver) checkColumns(cols []string) error {
+	report := colcheck.Compare(a.srcTbl, cols, a.dstTbl)
+	if len(report) == 0 {
+		return nil
+	}
+	if report.Fatal() {
+		return fmt.Errorf("The columns of %v and %v differ:\n%v\nUse --check-columns=false to archive anyway",
+			a.srcName, a.dstName, report)
+	}
+	if a.id == 0 {
+		fmt.Fprintf(os.Stderr, "The columns of %v and %v differ:\n%v\n", a.srcName, a.dstName, report)
+	}
+	return nil
+}
+
+// prepareVerify generates the SELECT reading an archived row in dest. The
+// key of the DELETE statement is used, so its columns must all be inserted
+// in dest.
+func (a *Archiver) prepareVerify() error {
+	for _, col := range a.del.Scols {
+		if !slices.Contains(a.ins.Cols, col) {
+			return fmt.Errorf("Cannot verify the rows in %v, the column %v is not archived", a.dstName,
+				quoter.Backtick([]string{col}))
+		}
+	}
+	a.verifySql = "SELECT " + backtickList(a.ins.Cols) + " FROM " + a.dstName + " WHERE " + a.del.Where + " LIMIT 1"
+	debug.Printvar("Verify statement", a.verifySql)
+	return nil
+}
+
+// verifyDest checks the rows are in dest with the archived values before
+// deleting them from source, dest being read within its transaction. The
+// keys of the rows missing and the columns differing are reported.
+func (a *Archiver) verifyDest(rows [][]sql.NullString) error {
+	var missing, differ []string
+	found := make([]sql.NullString, len(a.ins.Cols))
+	dests := make([]any, len(found))
+	for i := range found {
+		dests[i] = &found[i]
+	}
+	for _, row := range rows {
+		args := bindArgs(row, a.del.Slice)
+		var err error
+		GenStats(a.config, "verify", func() {
+			if a.dstTx != nil {
+				err = a.dstTx.QueryRowContext(a.ctx, a.verifySql, args...).Scan(dests...)
+			} else {
+				err = a.dst.Dbh.QueryRowContext(a.ctx, a.verifySql, args...).Scan(dests...)
+			}
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			missing = append(missing, keyString(a.del.Scols, args))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to verify the rows in %v: %w", a.dstName, err)
+		}
+		if cols := diffCols(a.ins.Cols, bindValues(row, a.ins.Slice), found); len(cols) > 0 {
+			differ = append(differ, keyString(a.del.Scols, args)+" ("+backtickList(cols)+")")
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%d archived rows not found in %v, not deleting them: %v", len(missing), a.dstName,
+			strings.Join(missing, "; "))
+	}
+	if len(differ) > 0 {
+		return fmt.Errorf("%d archived rows differ in %v, not deleting them: %v", len(differ), a.dstName,
+			strings.Join(differ, "; "))
+	}
+	return nil
+}
+
+// bindValues returns the values of the row at the ordinals of slice
+func bindValues(row []sql.NullString, slice []int) []sql.NullString {
+	vals := make([]sql.NullString, len(slice))
+	for i, ord := range slice {
+		vals[i] = row[ord]
+	}
+	return vals
+}
+
+// diffCols returns the columns whose values differ, NULL only equals NULL
+// and an empty string is not NULL.
+func diffCols(cols []string, want []sql.NullString, got []sql.NullString) []string {
+	var diff []string
+	for i, col := range cols {
+		if want[i].Valid != got[i].Valid || want[i].String != got[i].String {
+			diff = append(diff, col)
+		}
+	}
+	return diff
+}
+
+// keyString returns the columns and values of a key, for the error messages
+func keyString(cols []string, args []any) string {
+	pairs := make([]string, 0, len(cols))
+	for i, col := range cols {
+		// Nullable columns are bound twice
+		if i > 0 && cols[i-1] == col {
+			continue
+		}
+		pairs = append(pairs, col+"="+quoter.Quoteval(args[i].(sql.NullString), "char"))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// safeAutoInc keeps the row with the maximum AUTO_INCREMENT value out of the
+// archive, otherwise InnoDB could reuse its id after a restart. Like the Perl
+// tool, the check only applies to a single column index.
+func (a *Archiver) safeAutoInc() error {
+	cols := a.srcTbl.KeyCols(a.index)
+	if len(cols) != 1 || !a.srcTbl.ColIsAutoinc(cols[0]) {
+		return nil
+	}
+	col := quoter.Backtick([]string{cols[0]})
+	var max sql.NullString
+	err := a.src.Dbh.QueryRow("SELECT MAX(" + col + ") FROM " + a.srcName).Scan(&max)
+	if err != nil {
+		return fmt.Errorf("Unable to get the maximum auto-increment value of %v: %w", a.srcName, err)
+	}
+	if max.Valid {
+		a.autoIncMax = " AND (" + col + " < " + quoter.Quoteval(max, "int") + ")"
+	}
+	debug.Printvar("Auto-increment safety check", a.autoIncMax)
+	return nil
+}
+
+// prepareInsertSelect generates the INSERT ... SELECT copying a chunk from
+// source to dest on the same server. Only the columns of the index are
+// fetched, to get the boundaries of the chunks, and the ones referenced by
+// the child rows.
+func (a *Archiver) prepareInsertSelect(cols []string) error {
+	var err error
+	fetched := appendMissing(a.srcTbl.KeyCols(a.index), a.childParentCols())
+	a.asc, err = tablenibbler.GenerateAscStmt(a.srcTbl, a.index, fetched, a.config.AscendFirst, 0, true)
+	if err != nil {
+		return err
+	}
+	a.selCols = a.asc.Cols
+	a.outCols = len(a.selCols)
+	debug.PrintArray("Columns selected", a.selCols, ", ")
+
+	if !a.config.NoSafeAutoInc {
+		if err := a.safeAutoInc(); err != nil {
+			return err
+		}
+	}
+
+	if len(cols) == 0 {
+		cols = a.srcTbl.GetCols()
+	}
+	if a.config.CheckColumns {
+		if err := a.checkColumns(cols); err != nil {
+			return err
+		}
+	}
+	a.ins, err = tablenibbler.GenerateInsStmt(a.dstTbl, cols)
+	if err != nil {
+		return err
+	}
+	debug.Printvar("INSERT ... SELECT statement", a.insertSelectSql())
+	return nil
+}
+
+// insertSelectSql returns the INSERT ... SELECT copying the rows between the
+// first and the last rows of a chunk. Like the bulk DELETE, it is built for
+// each chunk since --chunk-time changes the limit.
+func (a *Archiver) insertSelectSql() string {
+	sqlStr := a.insertVerb() + " INTO " + a.dstName + " (" + backtickList(a.ins.Cols) + ") SELECT " +
+		backtickList(a.ins.Cols) + " FROM " + a.srcName + " FORCE INDEX(" + quoter.Backtick([]string{a.index}) + ")" +
+		" WHERE " + a.chunkWhere()
+	if a.config.BulkDeleteLimit {
+		sqlStr = sqlStr + " ORDER BY " + backtickList(a.srcTbl.KeyCols(a.index)) + " LIMIT " + strconv.Itoa(a.limit)
+	}
+	return sqlStr
+}
+
+// sameServer returns an error unless source and dest are the same server,
+// compared by @@server_uuid.
+func (a *Archiver) sameServer() error {
+	var srcUuid, dstUuid string
+	if err := a.src.Dbh.QueryRow("SELECT @@server_uuid").Scan(&srcUuid); err != nil {
+		return fmt.Errorf("Unable to get the server_uuid of the source: %v", err)
+	}
+	if err := a.dst.Dbh.QueryRow("SELECT @@server_uuid").Scan(&dstUuid); err != nil {
+		return fmt.Errorf("Unable to get the server_uuid of dest: %v", err)
+	}
+	if srcUuid != dstUuid {
+		return fmt.Errorf("'insert-select' requires source and dest on the same server, their server_uuid are %v and %v",
+			srcUuid, dstUuid)
+	}
+	return nil
+}
+
+// insertSelect copies the rows between the first and last rows of the chunk
+// with a single statement run on the source, in its transaction.
+func (a *Archiver) insertSelect(chunk [][]sql.NullString) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+	args := append(bindArgs(chunk[0], a.asc.Slice), bindArgs(chunk[len(chunk)-1], a.asc.Slice)...)
+	query := a.insertSelectSql()
+	var res sql.Result
+	var err error
+	GenStats(a.config, "INSERT_SELECT", func() {
+		res, err = a.srcExec(query, args...)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to copy the chunk to %v: %w", a.dstName, err)
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	// IGNORE skips rows and REPLACE counts the deleted rows
+	if !a.config.Ignore && !a.config.Replace && inserted != int64(len(chunk)) {
+		return fmt.Errorf("INSERT ... SELECT copied %d rows to %v but the chunk has %d rows, rolling back",
+			inserted, a.dstName, len(chunk))
+	}
+	a.pending.inserted += int64(len(chunk))
+	return nil
+}
+
+// bulkReaderName is the name of the reader handler feeding LOAD DATA,
+// suffixed by the worker number.
+const bulkReaderName = "pt-archiver-bulk-insert"
+
+// prepareBulkInsert registers the in-memory reader used by LOAD DATA LOCAL
+// INFILE, the chunk never touches a temporary file.
+func (a *Archiver) prepareBulkInsert() {
+	a.readerName = fmt.Sprintf("%v-%d", bulkReaderName, a.id)
+	mysql.RegisterReaderHandler(a.readerName, func() io.Reader {
+		return bytes.NewReader(a.bulkBuf.Bytes())
+	})
+
+	modifier := ""
+	if a.config.Replace {
+		modifier = "REPLACE "
+	} else if a.config.Ignore {
+		modifier = "IGNORE "
+	}
+	a.bulkSql = "LOAD DATA LOCAL INFILE 'Reader::" + a.readerName + "' " + modifier +
+		"INTO TABLE " + a.dstName
+	if len(a.dst.Charset) > 0 {
+		a.bulkSql = a.bulkSql + " CHARACTER SET " + a.dst.Charset
+	}
+	a.bulkSql = a.bulkSql + " " + outfile.Dump.Clause() + " (" + backtickList(a.ins.Cols) + ")"
+	debug.Printvar("Bulk INSERT statement", a.bulkSql)
+}
+
+// bulkInsert loads all the rows of the chunk in dest with a single statement
+func (a *Archiver) bulkInsert(chunk [][]sql.NullString) error {
+	a.bulkBuf.Reset()
+	out, err := outfile.NewOutfileDest(&a.bulkBuf, "dump")
+	if err != nil {
+		return err
+	}
+	if len(chunk) == 0 {
+		return nil
+	}
+	if a.plugin != nil {
+		if err := a.plugin.BeforeBulkInsert(chunk[0], chunk[len(chunk)-1]); err != nil {
+			return err
+		}
+	}
+	for _, row := range chunk {
+		if err := out.Write([][]sql.NullString{bindValues(row, a.ins.Slice)}); err != nil {
+			return err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	GenStats(a.config, "bulk_inserting", func() {
+		_, err = a.dstExec(a.bulkSql)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to bulk insert in %v: %w", a.dstName, err)
+	}
+	a.pending.inserted += int64(len(chunk))
+	return nil
+}
+
+// selectSql returns the SELECT fetching the next chunk, after the boundary
+// clause. The first chunk doesn't have a boundary unless resumed, neither
+// does the --no-ascend mode.
+func (a *Archiver) selectSql(boundary string) string {
+	sqlStr := "SELECT /*!40001 SQL_NO_CACHE */ " + backtickList(a.selCols) +
+		" FROM " + a.srcName + " FORCE INDEX(" + quoter.Backtick([]string{a.index}) + ")" +
+		" WHERE (" + a.config.Where + ")"
+	if len(boundary) > 0 {
+		sqlStr = sqlStr + " AND " + boundary
+	}
+	if a.upper != nil {
+		sqlStr = sqlStr + " AND " + a.rangeAsc.Boundaries["<"]
+	}
+	sqlStr = sqlStr + a.autoIncMax
+	orderCols := a.srcTbl.KeyCols(a.index)
+	if a.config.AscendFirst {
+		orderCols = orderCols[0:1]
+	}
+	return sqlStr + " ORDER BY " + backtickList(orderCols) + " LIMIT " + strconv.Itoa(a.limit) + a.lock
+}
+
+// lockClause returns the locking clause of the SELECT for a server version.
+// FOR SHARE and the SKIP LOCKED and NOWAIT modifiers appeared in MySQL 8.0.1,
+// MariaDB only has LOCK IN SHARE MODE. Unknown versions are assumed newer.
+func lockClause(config *Configuration, serverVersion string) (string, error) {
+	if !config.ForUpdate && !config.ShareLock {
+		return "", nil
+	}
+	c, err := version.Compare(serverVersion, "8.0.1")
+	older := err == nil && c < 0
+	clause := " FOR UPDATE"
+	if config.ShareLock {
+		clause = " FOR SHARE"
+		if older || strings.Contains(strings.ToLower(serverVersion), "mariadb") {
+			clause = " LOCK IN SHARE MODE"
+		}
+	}
+	modifier := ""
+	if config.SkipLocked {
+		modifier = " SKIP LOCKED"
+	} else if config.NoWait {
+		modifier = " NOWAIT"
+	}
+	if len(modifier) > 0 && older {
+		return "", fmt.Errorf("%v requires MySQL 8.0.1 or newer, the server is %v", strings.TrimSpace(modifier), serverVersion)
+	}
+	return clause + modifier, nil
+}
+
+// transactional returns true when the rows are archived in explicit transactions
+func (a *Archiver) transactional() bool {
+	return a.config.CommitEach || a.config.TxnSize > 0
+}
+
+// begin opens the transactions on source and dest if not already opened
+func (a *Archiver) begin() error {
+	if !a.transactional() {
+		return nil
+	}
+	var err error
+	if a.srcTx == nil {
+		a.srcTx, err = a.src.Dbh.BeginTx(a.ctx, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if a.hasDest && a.dstTx == nil {
+		a.dstTx, err = a.dst.Dbh.BeginTx(a.ctx, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commit commits the dest transaction first and then the source one, like
+// the Perl tool. When dest fails to commit, the source transaction is rolled
+// back and the rows stay in source. When source fails to commit after dest,
+// or the tool crashes in between, the rows are in both tables: they may be
+// duplicated in dest but they are never lost. The --checkpoint-table row is
+// written in the source transaction, the boundary commits with the deletes.
+func (a *Archiver) commit() error {
+	if _, ok := a.checkpoint.(*checkpoint.TableStore); ok && a.srcTx != nil {
+		if err := a.saveCheckpoint(a.srcTx); err != nil {
+			return err
+		}
+	}
+	if err := a.writeFile(); err != nil {
+		return err
+	}
+	if err := a.syncFile(); err != nil {
+		return err
+	}
+	var dstErr, srcErr error
+	GenStats(a.config, "COMMIT", func() {
+		if a.dstTx != nil {
+			dstErr = a.dstTx.Commit()
+			a.dstTx = nil
+			if dstErr != nil {
+				return
+			}
+		}
+		if a.srcTx != nil {
+			srcErr = a.srcTx.Commit()
+			a.srcTx = nil
+		}
+	})
+	rows := a.txnRows
+	a.txnRows = 0
+	counts := a.pending
+	a.pending = rowCounts{}
+	if dstErr != nil {
+		a.rollback()
+		return fmt.Errorf("Unable to commit on %v, the transaction on %v was rolled back: %w", a.dstName, a.srcName, dstErr)
+	}
+	if srcErr != nil && !a.hasDest {
+		return fmt.Errorf("Unable to commit on %v: %w", a.srcName, srcErr)
+	}
+	if srcErr != nil {
+		// Not retryable, the rows would be inserted again in dest
+		a.txnLast = nil
+		return fmt.Errorf("Unable to commit on %v after committing %d rows on %v, they may be duplicated: %v",
+			a.srcName, rows, a.dstName, srcErr)
+	}
+	a.run.add(counts)
+	return a.saveCheckpoint(nil)
+}
+
+// rollback aborts the opened transactions
+func (a *Archiver) rollback() {
+	if a.dstTx != nil {
+		a.dstTx.Rollback()
+		a.dstTx = nil
+	}
+	if a.srcTx != nil {
+		a.srcTx.Rollback()
+		a.srcTx = nil
+	}
+	a.txnRows = 0
+	a.txnLast = nil
+	a.fileRows = a.fileRows[:0]
+	a.pending = rowCounts{}
+}
+
+// srcExec runs a statement on the source, within the transaction if any
+func (a *Archiver) srcExec(query string, args ...any) (sql.Result, error) {
+	if a.srcTx != nil {
+		return a.srcTx.ExecContext(a.ctx, query, args...)
+	}
+	return a.src.Dbh.ExecContext(a.ctx, query, args...)
+}
+
+// dstExec runs a statement on the dest, within the transaction if any
+func (a *Archiver) dstExec(query string, args ...any) (sql.Result, error) {
+	if a.dstTx != nil {
+		return a.dstTx.ExecContext(a.ctx, query, args...)
+	}
+	return a.dst.Dbh.ExecContext(a.ctx, query, args...)
+}
+
+// srcRows runs a SELECT of ncols columns on the source, within the
+// transaction if any. All the rows are read before returning since the
+// connection can't be used while a result set is open.
+func (a *Archiver) srcRows(query string, ncols int, args ...any) ([][]sql.NullString, error) {
+	var rows *sql.Rows
+	var err error
+	if a.srcTx != nil {
+		rows, err = a.srcTx.QueryContext(a.ctx, query, args...)
+	} else {
+		rows, err = a.src.Dbh.QueryContext(a.ctx, query, args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result [][]sql.NullString
+	for rows.Next() {
+		row := make([]sql.NullString, ncols)
+		ptrs := make([]any, len(row))
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// fetch returns the next chunk of rows. All the rows are read before
+// returning since the connection can't be used while a result set is open.
+func (a *Archiver) fetch() ([][]sql.NullString, error) {
+	if err := a.begin(); err != nil {
+		return nil, err
+	}
+
+	var boundary string
+	var args []any
+	if a.lastRow != nil && !a.config.NoAscend {
+		boundary = a.asc.Where
+		args = bindArgs(a.lastRow, a.asc.Slice)
+	} else if a.lastRow == nil && a.resume != nil {
+		boundary = a.asc.Boundaries[">"]
+		args = a.resume
+	} else if a.lower != nil {
+		boundary = a.rangeAsc.Boundaries[">="]
+		args = a.lower
+	}
+	args = append(args, a.upper...)
+	query := a.selectSql(boundary)
+
+	var chunk [][]sql.NullString
+	var err error
+	start := time.Now()
+	GenStats(a.config, "SELECT", func() {
+		chunk, err = a.srcRows(query, len(a.selCols), args...)
+	})
+	a.run.selected.Add(int64(len(chunk)))
+	a.selectTime = time.Since(start)
+	a.sleepFor(a.selectTime)
+	return chunk, err
+}
+
+// sleepFor computes the time to sleep after the next commit, --sleep-coef
+// being a multiple of the last SELECT time.
+func (a *Archiver) sleepFor(selectTime time.Duration) {
+	if a.config.SleepCoef > 0 {
+		a.sleep = time.Duration(float64(selectTime) * a.config.SleepCoef)
+	}
+}
+
+// chunkWhere returns the condition matching the rows between the first and
+// the last rows of a chunk, boundaries included.
+func (a *Archiver) chunkWhere() string {
+	return a.asc.Boundaries[">="] + " AND " + a.asc.Boundaries["<="] + " AND (" + a.config.Where + ")"
+}
+
+// bulkDeleteSql returns the DELETE removing all the rows between the first
+// and the last rows of a chunk, boundaries included.
+func (a *Archiver) bulkDeleteSql() string {
+	sqlStr := "DELETE FROM " + a.srcName + " WHERE " + a.chunkWhere()
+	if a.config.BulkDeleteLimit {
+		sqlStr = sqlStr + " LIMIT " + strconv.Itoa(a.limit)
+	}
+	return sqlStr
+}
+
+// bulkDelete deletes the rows of the chunk with a single statement. The
+// number of rows deleted must match the chunk size otherwise rows that were
+// not archived would be lost, an error is returned so the transaction is
+// rolled back.
+func (a *Archiver) bulkDelete(chunk [][]sql.NullString) error {
+	// All the boundaries have the same placeholders as the ascending where
+	args := append(bindArgs(chunk[0], a.asc.Slice), bindArgs(chunk[len(chunk)-1], a.asc.Slice)...)
+	query := a.bulkDeleteSql()
+	debug.Printvar("Bulk DELETE statement", query)
+	if a.plugin != nil {
+		if err := a.plugin.BeforeBulkDelete(chunk[0], chunk[len(chunk)-1]); err != nil {
+			return err
+		}
+	}
+
+	var res sql.Result
+	var err error
+	GenStats(a.config, "bulk_deleting", func() {
+		res, err = a.srcExec(query, args...)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to bulk delete from %v: %w", a.srcName, err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted != int64(len(chunk)) {
+		return fmt.Errorf("Bulk delete removed %d rows from %v but %d rows were archived, rolling back",
+			deleted, a.srcName, len(chunk))
+	}
+	a.pending.deleted += deleted
+	return nil
+}
+
+// archiveRow inserts the row in dest and deletes it from source
+func (a *Archiver) archiveRow(row []sql.NullString) error {
+	var err error
+	if a.plugin != nil {
+		archivable, err := a.plugin.IsArchivable(row)
+		if err != nil {
+			return err
+		}
+		if !archivable {
+			debug.Print("Row is not archivable")
+			return nil
+		}
+	}
+	a.archived = append(a.archived, row)
+
+	if a.sink != nil {
+		a.fileRows = append(a.fileRows, row[:a.outCols])
+	}
+	if a.hasDest && !a.config.BulkInsert && !a.config.InsertSelect && a.doneInsert {
+		// Replayed after a failed DELETE, the INSERT was committed
+		a.pending.inserted++
+	} else if a.hasDest && !a.config.BulkInsert && !a.config.InsertSelect {
+		query := a.insSql
+		if a.plugin != nil {
+			if err = a.plugin.BeforeInsert(row); err != nil {
+				return err
+			}
+			custom, err := a.plugin.CustomSql(row, query)
+			if err != nil {
+				return err
+			}
+			if len(custom) > 0 {
+				query = custom
+			}
+		}
+		GenStats(a.config, "INSERT", func() {
+			_, err = a.dstExec(query, bindArgs(row, a.ins.Slice)...)
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to insert in %v: %w", a.dstName, err)
+		}
+		a.pending.inserted++
+		a.doneInsert = !a.transactional()
+		if len(a.verifySql) > 0 {
+			if err = a.verifyDest([][]sql.NullString{row}); err != nil {
+				return err
+			}
+		}
+	}
+	if !a.config.NoDelete && !a.config.BulkDelete {
+		if a.plugin != nil {
+			if err = a.plugin.BeforeDelete(row); err != nil {
+				return err
+			}
+		}
+		if a.config.ArchiveChildren {
+			if err = a.archiveChildren([][]sql.NullString{row}); err != nil {
+				return err
+			}
+		}
+		GenStats(a.config, "DELETE", func() {
+			_, err = a.srcExec(a.delSql, bindArgs(row, a.del.Slice)...)
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to delete from %v: %w", a.srcName, err)
+		}
+		a.pending.deleted++
+	}
+	a.pending.archived++
+	return nil
+}
+
+// withRetry calls f with the --retry policy. On deadlocks and lock wait
+// timeouts, the transaction is rolled back before calling f again, unless it
+// holds rows of a previous chunk which would then be skipped.
+func (a *Archiver) withRetry(f func() error) error {
+	a.carried = a.txnRows
+	return a.policy.Do(f, func(err error) error {
+		if a.carried > 0 {
+			return fmt.Errorf("%w (not retried, the transaction spans multiple chunks)", err)
+		}
+		debug.Printvar("Retrying after", err)
+		a.rollback()
+		AddStat("retries", 1)
+		return nil
+	})
+}
+
+// archiveChunk archives the rows of a chunk, committing every --txn-size
+// rows or at the end with --commit-each. When replayed after a rollback, the
+// rows already committed are skipped, as is the committed INSERT of a row
+// whose DELETE failed without a transaction.
+func (a *Archiver) archiveChunk(chunk [][]sql.NullString) error {
+	if err := a.begin(); err != nil {
+		return err
+	}
+	a.archived = a.archived[:0]
+	for i := a.done; i < len(chunk); i++ {
+		if err := a.archiveRow(chunk[i]); err != nil {
+			return err
+		}
+		a.txnRows++
+		a.txnLast = chunk[i]
+		// Without a transaction the row is already committed, it must not
+		// be archived again if the chunk is replayed.
+		if !a.transactional() {
+			if err := a.publish(); err != nil {
+				return err
+			}
+			a.done = i + 1
+			a.doneInsert = false
+			a.txnRows = 0
+			continue
+		}
+		if !a.config.CommitEach && a.config.TxnSize > 0 && a.txnRows >= a.config.TxnSize {
+			if err := a.commit(); err != nil {
+				return err
+			}
+			a.done = i + 1
+			a.carried = 0
+			// The next rows of the chunk must not run in autocommit
+			if i+1 < len(chunk) {
+				if err := a.begin(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if a.hasDest && a.config.BulkInsert {
+		if err := a.bulkInsert(a.archived); err != nil {
+			return err
+		}
+		if len(a.verifySql) > 0 {
+			if err := a.verifyDest(a.archived); err != nil {
+				return err
+			}
+		}
+	}
+	if a.config.InsertSelect {
+		if err := a.insertSelect(a.archived); err != nil {
+			return err
+		}
+	}
+	if a.config.BulkDelete && !a.config.NoDelete {
+		if a.config.ArchiveChildren {
+			if err := a.archiveChildren(chunk); err != nil {
+				return err
+			}
+		}
+		if err := a.bulkDelete(chunk); err != nil {
+			return err
+		}
+	}
+	if a.config.CommitEach {
+		return a.commit()
+	}
+	return nil
+}
+
+// fetchChunk fetches the next chunk with the --retry policy
+func (a *Archiver) fetchChunk() ([][]sql.NullString, error) {
+	var chunk [][]sql.NullString
+	err := a.withRetry(func() error {
+		var err error
+		chunk, err = a.fetch()
+		return err
+	})
+	return chunk, err
+}
+
+// Run is the main nibbling loop, it stops when no more rows are found, when
+// --run-time expires or when the stop sentinel file is created.
+func (a *Archiver) Run() error {
+	stop, err := a.sentinel.Wait()
+	if err != nil {
+		a.run.quit(quitError)
+		return err
+	}
+	if stop {
+		a.run.quit(quitSentinel)
+		return nil
+	}
+	if a.plugin != nil {
+		if err := a.plugin.BeforeBegin(a.selCols, a.srcTbl.GetCols()); err != nil {
+			a.run.quit(quitError)
+			return err
+		}
+	}
+
+	chunk, err := a.fetchChunk()
+	for err == nil && len(chunk) > 0 {
+		a.done, a.doneInsert = 0, false
+		start := time.Now()
+		err = a.withRetry(func() error {
+			return a.archiveChunk(chunk)
+		})
+		if err != nil {
+			break
+		}
+		a.lastRow = chunk[len(chunk)-1]
+		if a.sizer != nil {
+			a.limit = a.sizer.Update(len(chunk), a.selectTime+time.Since(start))
+			debug.Printvar("Next chunk size", a.limit)
+		}
+		if !a.transactional() {
+			if err = a.syncFile(); err != nil {
+				break
+			}
+			if err = a.saveCheckpoint(nil); err != nil {
+				break
+			}
+		}
+
+		if a.run.expired() {
+			a.run.quit(quitRunTime)
+			break
+		}
+		if a.sleep > 0 {
+			if err = a.commit(); err != nil {
+				break
+			}
+			a.pause(a.sleep)
+		}
+		if err = a.waitThrottle(); err != nil {
+			break
+		}
+		if stop, err = a.sentinel.Wait(); err != nil {
+			break
+		}
+		if stop {
+			a.run.quit(quitSentinel)
+			break
+		}
+		if a.halted() {
+			if a.signal != nil {
+				a.run.quit(quitSignal + a.signal.String())
+			} else {
+				a.run.quit(quitWorker)
+			}
+			break
+		}
+		chunk, err = a.fetchChunk()
+	}
+
+	if err == nil {
+		a.run.quit(quitExhausted)
+		err = a.commit()
+	}
+	// The next run starts from the beginning of the index
+	if err == nil && a.run.exitReason() == quitExhausted && a.checkpoint != nil {
+		err = a.checkpoint.Clear()
+	}
+	if err != nil {
+		a.run.quit(quitError)
+		a.rollback()
+		return err
+	}
+	if a.plugin != nil {
+		return a.plugin.AfterFinish()
+	}
+	return nil
+}
+
+// halt asks the main loop to stop after the current chunk, because of a
+// signal or, when sig is nil, because another worker failed.
+func (a *Archiver) halt(sig os.Signal) {
+	a.stopOnce.Do(func() {
+		a.signal = sig
+		close(a.stop)
+	})
+}
+
+// halted returns true once halt was called
+func (a *Archiver) halted() bool {
+	select {
+	case <-a.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Interrupt asks the main loop to stop after the current chunk
+func (a *Archiver) Interrupt(sig os.Signal) {
+	a.halt(sig)
+}
+
+// Interrupted returns the signal passed to Interrupt, nil if not interrupted
+func (a *Archiver) Interrupted() os.Signal {
+	if a.halted() {
+		return a.signal
+	}
+	return nil
+}
+
+// Abort cancels the running statement, the transactions opened with the
+// canceled context are rolled back.
+func (a *Archiver) Abort() {
+	a.cancel()
+}
+
+// waitThrottle waits for the throttlers. The wait is given up when the
+// archiver is halted or when the stop sentinel file appears, a stopped
+// replica would block it forever otherwise.
+func (a *Archiver) waitThrottle() error {
+	done := make(chan struct{})
+	waited := make(chan struct{})
+	defer close(waited)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-waited:
+				return
+			case <-time.After(a.sentinel.Interval):
+				// Errors are reported by the sentinel check after the wait
+				if stop, _ := a.sentinel.Stopped(); stop {
+					return
+				}
+			}
+		}
+	}()
+	return a.throttle.Wait(done)
+}
+
+// pause sleeps for d unless interrupted
+func (a *Archiver) pause(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-a.stop:
+	}
+}
+
+// Close releases the database connections. The --file output is synced to
+// disk so nothing archived is lost if the host crashes right after.
+func (a *Archiver) Close() {
+	a.rollback()
+	a.cancel()
+	if len(a.bulkSql) > 0 {
+		mysql.DeregisterReaderHandler(a.readerName)
+	}
+	if a.sink != nil {
+		name := a.sink.Name()
+		if err := a.sink.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to close %v: %v\n", name, err)
+		}
+	}
+	if a.src.Dbh != nil {
+		a.src.Dbh.Close()
+	}
+	if a.dst.Dbh != nil {
+		a.dst.Dbh.Close()
+	}
+}
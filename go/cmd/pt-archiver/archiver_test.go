@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/y-trudeau/go-toolkit/go/pkg/tablenibbler"
+	"github.com/y-trudeau/go-toolkit/go/pkg/tableparser"
+
+	"go-toolkit/pkg/checkpoint"
+	"go-toolkit/pkg/filesink"
+	"go-toolkit/pkg/retry"
+)
+
+// fakeArchiver returns an archiver of the `id`,`v` rows of `db`.`t` to
+// `arch`.`t` and to the file, on fake databases.
+func fakeArchiver(t *testing.T, config *Configuration, src *fakeDb, dst *fakeDb) *Archiver {
+	Statistics = make(map[string]int64)
+	a := &Archiver{config: config, hasDest: true, srcName: "`db`.`t`", dstName: "`arch`.`t`",
+		selCols: []string{"id", "v"}, outCols: 2, limit: config.Limit,
+		ins:    tablenibbler.InsStmt{Cols: []string{"id", "v"}, Slice: []int{0, 1}},
+		del:    tablenibbler.DelStmt{Scols: []string{"id"}, Slice: []int{0}},
+		insSql: "INSERT INTO `arch`.`t` (`id`,`v`) VALUES (?,?)",
+		delSql: "DELETE FROM `db`.`t` WHERE (`id` = ?)",
+		run:    newRunControl(config, io.Discard),
+		policy: retry.Policy{Retries: config.Retries, Sleep: func(time.Duration) {}},
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	a.src.Dbh = openFake(t.Name()+"/src", src)
+	a.dst.Dbh = openFake(t.Name()+"/dst", dst)
+	if len(config.File) > 0 {
+		a.sink = &filesink.Sink{Template: config.File}
+	}
+	return a
+}
+
+// ordersTable is the source table of the tests built from a parsed CREATE
+// TABLE.
+const ordersTable = "CREATE TABLE `orders` (\n" +
+	"  `id` bigint unsigned NOT NULL AUTO_INCREMENT,\n" +
+	"  `customer_id` int NOT NULL,\n" +
+	"  `created` datetime NOT NULL,\n" +
+	"  `note` varchar(64) DEFAULT NULL,\n" +
+	"  PRIMARY KEY (`id`),\n" +
+	"  KEY `created_id` (`created`,`id`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// parsedTable returns the TableInfo of ddl
+func parsedTable(t *testing.T, ddl string) tableparser.TableInfo {
+	t.Helper()
+	tbl, err := tableparser.Parse(ddl)
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+	return tbl
+}
+
+// rowsOf returns rows of the values, all valid
+func rowsOf(vals ...[]string) [][]sql.NullString {
+	var rows [][]sql.NullString
+	for _, v := range vals {
+		row := make([]sql.NullString, len(v))
+		for i := range v {
+			row[i] = sql.NullString{String: v[i], Valid: true}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestPrepareBulkInsert(t *testing.T) {
+	for _, c := range []struct {
+		config  Configuration
+		charset string
+		e       string
+	}{
+		{Configuration{}, "utf8mb4", "LOAD DATA LOCAL INFILE 'Reader::pt-archiver-bulk-insert-2' INTO TABLE `arch`.`t` CHARACTER SET utf8mb4 " +
+			"FIELDS TERMINATED BY '\\t' ESCAPED BY '\\\\' LINES TERMINATED BY '\\n' (`id`,`v`)"},
+		{Configuration{Replace: true}, "", "LOAD DATA LOCAL INFILE 'Reader::pt-archiver-bulk-insert-2' REPLACE INTO TABLE `arch`.`t` " +
+			"FIELDS TERMINATED BY '\\t' ESCAPED BY '\\\\' LINES TERMINATED BY '\\n' (`id`,`v`)"},
+		{Configuration{Ignore: true}, "", "LOAD DATA LOCAL INFILE 'Reader::pt-archiver-bulk-insert-2' IGNORE INTO TABLE `arch`.`t` " +
+			"FIELDS TERMINATED BY '\\t' ESCAPED BY '\\\\' LINES TERMINATED BY '\\n' (`id`,`v`)"},
+	} {
+		a := &Archiver{config: &c.config, id: 2, dstName: "`arch`.`t`",
+			ins: tablenibbler.InsStmt{Cols: []string{"id", "v"}, Slice: []int{0, 1}}}
+		a.dst.Charset = c.charset
+		a.prepareBulkInsert()
+		if a.bulkSql != c.e {
+			t.Errorf("prepareBulkInsert: expected %q, got %q", c.e, a.bulkSql)
+		}
+	}
+}
+
+func TestRetryFile(t *testing.T) {
+	chunk := rowsOf([]string{"1", "a"}, []string{"2", "b"}, []string{"3", "c"})
+	for _, c := range []struct {
+		name   string
+		config Configuration
+	}{
+		{"commit-each", Configuration{CommitEach: true, Retries: 1, Limit: 3}},
+		{"buffer", Configuration{CommitEach: true, Retries: 1, Limit: 3, Buffer: true}},
+		{"txn-size", Configuration{TxnSize: 2, Retries: 1, Limit: 3}},
+		{"no transaction", Configuration{Retries: 1, Limit: 3}},
+	} {
+		// The second INSERT of the chunk deadlocks once
+		inserts := 0
+		dst := &fakeDb{exec: func(query string, args []driver.NamedValue) (int64, error) {
+			inserts++
+			if inserts == 2 {
+				return 0, &mysql.MySQLError{Number: retry.ErLockDeadlock, Message: "Deadlock found"}
+			}
+			return 1, nil
+		}}
+		c.config.File = filepath.Join(t.TempDir(), "rows.txt")
+		a := fakeArchiver(t, &c.config, &fakeDb{}, dst)
+		err := a.withRetry(func() error {
+			return a.archiveChunk(chunk)
+		})
+		if err == nil {
+			err = a.commit()
+		}
+		if err != nil {
+			t.Fatalf("%v: archiveChunk returned an error: %v", c.name, err)
+		}
+		a.Close()
+
+		data, _ := os.ReadFile(c.config.File)
+		if string(data) != "1\ta\n2\tb\n3\tc\n" {
+			t.Errorf("%v: each row must be in the file once, got %q", c.name, data)
+		}
+		if a.run.inserted.Load() != 3 || a.run.deleted.Load() != 3 || a.run.archived.Load() != 3 {
+			t.Errorf("%v: expected 3 rows counted, got %d inserted, %d deleted, %d archived", c.name,
+				a.run.inserted.Load(), a.run.deleted.Load(), a.run.archived.Load())
+		}
+		if Statistics["retries"] != 1 {
+			t.Errorf("%v: expected 1 retry, got %d", c.name, Statistics["retries"])
+		}
+	}
+}
+
+func TestRetryDelete(t *testing.T) {
+	chunk := rowsOf([]string{"1", "a"}, []string{"2", "b"})
+	for _, c := range []struct {
+		name   string
+		config Configuration
+		e      []string // statements on dest
+	}{
+		{"commit-each", Configuration{CommitEach: true, Retries: 1, Limit: 2},
+			[]string{"INSERT", "INSERT", "ROLLBACK", "INSERT", "INSERT", "COMMIT"}},
+		{"txn-size", Configuration{TxnSize: 1, Retries: 1, Limit: 2},
+			[]string{"INSERT", "COMMIT", "INSERT", "ROLLBACK", "INSERT", "COMMIT"}},
+		{"no transaction", Configuration{Retries: 1, Limit: 2}, []string{"INSERT", "INSERT"}},
+	} {
+		// The DELETE of the second row deadlocks once, after its INSERT
+		deletes := 0
+		src := &fakeDb{exec: func(query string, args []driver.NamedValue) (int64, error) {
+			deletes++
+			if deletes == 2 {
+				return 0, &mysql.MySQLError{Number: retry.ErLockDeadlock, Message: "Deadlock found"}
+			}
+			return 1, nil
+		}}
+		dst := &fakeDb{}
+		a := fakeArchiver(t, &c.config, src, dst)
+		err := a.withRetry(func() error {
+			return a.archiveChunk(chunk)
+		})
+		if err != nil {
+			t.Fatalf("%v: archiveChunk returned an error: %v", c.name, err)
+		}
+		a.Close()
+
+		var stmts []string
+		for _, s := range dst.statements("") {
+			stmts = append(stmts, strings.Fields(s)[0])
+		}
+		if !slices.Equal(stmts, c.e) {
+			t.Errorf("%v: expected the statements %v on dest, got %v", c.name, c.e, stmts)
+		}
+		if a.run.inserted.Load() != 2 || a.run.deleted.Load() != 2 || a.run.archived.Load() != 2 {
+			t.Errorf("%v: expected 2 rows counted, got %d inserted, %d deleted, %d archived", c.name,
+				a.run.inserted.Load(), a.run.deleted.Load(), a.run.archived.Load())
+		}
+	}
+}
+
+func TestTxnSize(t *testing.T) {
+	src, dst := &fakeDb{}, &fakeDb{}
+	config := Configuration{TxnSize: 2, Limit: 4}
+	a := fakeArchiver(t, &config, src, dst)
+	chunk := rowsOf([]string{"1", "a"}, []string{"2", "b"}, []string{"3", "c"}, []string{"4", "d"})
+	if err := a.archiveChunk(chunk); err != nil {
+		t.Fatalf("archiveChunk returned an error: %v", err)
+	}
+	if err := a.commit(); err != nil {
+		t.Fatalf("commit returned an error: %v", err)
+	}
+	a.Close()
+
+	// Every --txn-size rows are committed, none in autocommit
+	for _, c := range []struct {
+		name string
+		db   *fakeDb
+		e    []string
+	}{
+		{"source", src, []string{"DELETE", "DELETE", "COMMIT", "DELETE", "DELETE", "COMMIT"}},
+		{"dest", dst, []string{"INSERT", "INSERT", "COMMIT", "INSERT", "INSERT", "COMMIT"}},
+	} {
+		var stmts []string
+		for _, s := range c.db.statements("") {
+			stmts = append(stmts, strings.Fields(s)[0])
+		}
+		if !slices.Equal(stmts, c.e) {
+			t.Errorf("Expected the statements %v on the %v, got %v", c.e, c.name, stmts)
+		}
+	}
+}
+
+func TestCommitOrder(t *testing.T) {
+	chunk := rowsOf([]string{"1", "a"}, []string{"2", "b"})
+	{
+		// Dest commits first
+		var commits []string
+		src := &fakeDb{commit: func() error { commits = append(commits, "source"); return nil }}
+		dst := &fakeDb{commit: func() error { commits = append(commits, "dest"); return nil }}
+		a := fakeArchiver(t, &Configuration{CommitEach: true, Limit: 2}, src, dst)
+		if err := a.archiveChunk(chunk); err != nil {
+			t.Fatalf("archiveChunk returned an error: %v", err)
+		}
+		a.Close()
+		if e := []string{"dest", "source"}; !slices.Equal(commits, e) {
+			t.Errorf("Expected the commits %v, got %v", e, commits)
+		}
+	}
+	{
+		// Dest fails to commit, the deletes are rolled back
+		src := &fakeDb{}
+		dst := &fakeDb{commit: func() error { return &mysql.MySQLError{Number: 1180, Message: "Got error during COMMIT"} }}
+		a := fakeArchiver(t, &Configuration{CommitEach: true, Limit: 2}, src, dst)
+		if err := a.archiveChunk(chunk); err == nil {
+			t.Errorf("archiveChunk didn't return an error when dest fails to commit")
+		}
+		a.Close()
+		if stmts := src.statements(""); stmts[len(stmts)-1] != "ROLLBACK" || len(src.statements("COMMIT")) > 0 {
+			t.Errorf("The source transaction must be rolled back, got %v", stmts)
+		}
+		if a.run.deleted.Load() != 0 || a.run.archived.Load() != 0 {
+			t.Errorf("Expected no row counted, got %d deleted, %d archived", a.run.deleted.Load(), a.run.archived.Load())
+		}
+	}
+}
+
+func TestCheckpointTable(t *testing.T) {
+	src := &fakeDb{}
+	config := Configuration{CommitEach: true, Limit: 3}
+	a := fakeArchiver(t, &config, src, &fakeDb{})
+	a.index = "PRIMARY"
+	a.asc = tablenibbler.AscStmt{Scols: []string{"id"}, Slice: []int{0}}
+	a.checkpoint = &checkpoint.TableStore{Dbh: a.src.Dbh, Name: "`db`.`cp`", Table: a.srcName}
+	if err := a.archiveChunk(rowsOf([]string{"1", "a"}, []string{"2", "b"})); err != nil {
+		t.Fatalf("archiveChunk returned an error: %v", err)
+	}
+	a.Close()
+
+	// The checkpoint is written in the transaction of the deletes
+	var stmts []string
+	for _, s := range src.statements("") {
+		stmts = append(stmts, strings.Fields(s)[0])
+	}
+	e := []string{"DELETE", "DELETE", "REPLACE", "COMMIT"}
+	if !slices.Equal(stmts, e) {
+		t.Errorf("Expected the statements %v on the source, got %v", e, stmts)
+	}
+}
+
+func TestDiffCols(t *testing.T) {
+	null := sql.NullString{}
+	val := func(s string) sql.NullString { return sql.NullString{String: s, Valid: true} }
+	cols := []string{"a", "b"}
+	for _, c := range []struct {
+		want, got []sql.NullString
+		e         []string
+	}{
+		{[]sql.NullString{val("1"), val("x")}, []sql.NullString{val("1"), val("x")}, nil},
+		{[]sql.NullString{null, null}, []sql.NullString{null, null}, nil},
+		// NULL is not an empty string, nor the string 'NULL'
+		{[]sql.NullString{null, val("")}, []sql.NullString{val(""), null}, []string{"a", "b"}},
+		{[]sql.NullString{val("NULL"), val("x")}, []sql.NullString{null, val("x")}, []string{"a"}},
+		{[]sql.NullString{val("1"), val("x")}, []sql.NullString{val("1"), val("X")}, []string{"b"}},
+		{[]sql.NullString{val("\xff\x00"), val("x")}, []sql.NullString{val("\xff"), val("x")}, []string{"a"}},
+	} {
+		if diff := diffCols(cols, c.want, c.got); !slices.Equal(diff, c.e) {
+			t.Errorf("diffCols(%v, %v): expected %v, got %v", c.want, c.got, c.e, diff)
+		}
+	}
+}
+
+func TestVerifyDest(t *testing.T) {
+	// Row 1 is identical, 2 has a different v, 3 is missing and 4 has a NULL v
+	dest := map[string][]driver.Value{
+		"1": {"1", "a"},
+		"2": {"2", "B"},
+		"4": {"4", nil},
+	}
+	dst := &fakeDb{query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if row, ok := dest[args[0].Value.(string)]; ok {
+			return []string{"id", "v"}, [][]driver.Value{row}, nil
+		}
+		return []string{"id", "v"}, nil, nil
+	}}
+	a := fakeArchiver(t, &Configuration{}, &fakeDb{}, dst)
+	a.del.Where = "(`id` = ?)"
+	a.prepareVerify()
+	if e := "SELECT `id`,`v` FROM `arch`.`t` WHERE (`id` = ?) LIMIT 1"; a.verifySql != e {
+		t.Errorf("prepareVerify: expected %q, got %q", e, a.verifySql)
+	}
+	null := rowsOf([]string{"4", ""})
+	null[0][1] = sql.NullString{}
+	for _, c := range []struct {
+		rows [][]sql.NullString
+		e    string
+	}{
+		{rowsOf([]string{"1", "a"}), ""},
+		{null, ""},
+		{rowsOf([]string{"1", "a"}, []string{"2", "b"}), "1 archived rows differ in `arch`.`t`, not deleting them: id='2' (`v`)"},
+		{rowsOf([]string{"4", ""}), "1 archived rows differ in `arch`.`t`, not deleting them: id='4' (`v`)"},
+		{rowsOf([]string{"3", "c"}, []string{"2", "b"}), "1 archived rows not found in `arch`.`t`, not deleting them: id='3'"},
+	} {
+		err := a.verifyDest(c.rows)
+		if (err == nil && c.e != "") || (err != nil && err.Error() != c.e) {
+			t.Errorf("verifyDest(%v): expected %q, got %v", c.rows, c.e, err)
+		}
+	}
+	a.Close()
+}
+
+func TestLockClause(t *testing.T) {
+	const invalid = "error"
+	// The clauses without modifier, with SKIP LOCKED and with NOWAIT
+	type locks struct{ plain, skipLocked, nowait string }
+	for _, c := range []struct {
+		version   string
+		forUpdate locks
+		shareLock locks
+	}{
+		{"5.7.44-log", locks{" FOR UPDATE", invalid, invalid}, locks{" LOCK IN SHARE MODE", invalid, invalid}},
+		{"8.0.0", locks{" FOR UPDATE", invalid, invalid}, locks{" LOCK IN SHARE MODE", invalid, invalid}},
+		{"8.0.1", locks{" FOR UPDATE", " FOR UPDATE SKIP LOCKED", " FOR UPDATE NOWAIT"},
+			locks{" FOR SHARE", " FOR SHARE SKIP LOCKED", " FOR SHARE NOWAIT"}},
+		{"8.0.36-28", locks{" FOR UPDATE", " FOR UPDATE SKIP LOCKED", " FOR UPDATE NOWAIT"},
+			locks{" FOR SHARE", " FOR SHARE SKIP LOCKED", " FOR SHARE NOWAIT"}},
+		// MariaDB only has LOCK IN SHARE MODE, old releases have the MySQL 5 numbering
+		{"10.11.6-MariaDB-log", locks{" FOR UPDATE", " FOR UPDATE SKIP LOCKED", " FOR UPDATE NOWAIT"},
+			locks{" LOCK IN SHARE MODE", " LOCK IN SHARE MODE SKIP LOCKED", " LOCK IN SHARE MODE NOWAIT"}},
+		{"5.5.68-MariaDB", locks{" FOR UPDATE", invalid, invalid}, locks{" LOCK IN SHARE MODE", invalid, invalid}},
+		// Unparsable versions are assumed newer
+		{"unknown", locks{" FOR UPDATE", " FOR UPDATE SKIP LOCKED", " FOR UPDATE NOWAIT"},
+			locks{" FOR SHARE", " FOR SHARE SKIP LOCKED", " FOR SHARE NOWAIT"}},
+	} {
+		for _, l := range []struct {
+			name   string
+			config Configuration
+			e      locks
+		}{
+			{"no lock", Configuration{}, locks{}},
+			{"for-update", Configuration{ForUpdate: true}, c.forUpdate},
+			{"share-lock", Configuration{ShareLock: true}, c.shareLock},
+		} {
+			for _, m := range []struct {
+				name               string
+				skipLocked, noWait bool
+				e                  string
+			}{
+				{"", false, false, l.e.plain},
+				{" skip-locked", true, false, l.e.skipLocked},
+				{" nowait", false, true, l.e.nowait},
+			} {
+				config := l.config
+				config.SkipLocked = m.skipLocked
+				config.NoWait = m.noWait
+				clause, err := lockClause(&config, c.version)
+				if err != nil {
+					clause = invalid
+				}
+				if clause != m.e {
+					t.Errorf("%v%v on %v: expected %q, got %q (%v)", l.name, m.name, c.version, m.e, clause, err)
+				}
+			}
+		}
+	}
+}
+
+func TestInsertSelectLimit(t *testing.T) {
+	a := planArchiver(t, &Configuration{InsertSelect: true, BulkDeleteLimit: true}, true)
+	src := &fakeDb{}
+	a.src.Dbh = openFake(t.Name(), src)
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	defer a.cancel()
+	e := "INSERT INTO `arch`.`items` (`order_id`,`line`,`sku`,`qty`) SELECT `order_id`,`line`,`sku`,`qty` " +
+		"FROM `db`.`items` FORCE INDEX(`PRIMARY`) WHERE ((`order_id` > ?) OR (`order_id` = ? AND `line` >= ?)) " +
+		"AND ((`order_id` < ?) OR (`order_id` = ? AND `line` <= ?)) AND (1=1) ORDER BY `order_id`,`line` LIMIT "
+	// --chunk-time changes the limit after prepare
+	for _, limit := range []int{100, 250, 7} {
+		a.limit = limit
+		if err := a.insertSelect(rowsOf([]string{"1", "1"})); err != nil {
+			t.Fatalf("insertSelect returned an error: %v", err)
+		}
+		stmts := src.statements("INSERT")
+		if last := stmts[len(stmts)-1]; last != e+strconv.Itoa(limit) {
+			t.Errorf("Limit %d: expected %q, got %q", limit, e+strconv.Itoa(limit), last)
+		}
+	}
+}
+
+func TestBulkDelete(t *testing.T) {
+	chunk := rowsOf([]string{"1", "1", "a", "1"}, []string{"1", "2", "b", "2"}, []string{"2", "1", "c", "3"})
+	e := "DELETE FROM `db`.`items` WHERE ((`order_id` > ?) OR (`order_id` = ? AND `line` >= ?)) " +
+		"AND ((`order_id` < ?) OR (`order_id` = ? AND `line` <= ?)) AND (1=1)"
+	for _, c := range []struct {
+		name    string
+		config  Configuration
+		deleted int64
+		e       string
+		valid   bool
+	}{
+		{"bulk-delete", Configuration{BulkDelete: true}, 3, e, true},
+		{"bulk-delete-limit", Configuration{BulkDelete: true, BulkDeleteLimit: true}, 3, e + " LIMIT 100", true},
+		// Rows that were not archived would be lost
+		{"more rows deleted", Configuration{BulkDelete: true}, 4, e, false},
+		{"less rows deleted", Configuration{BulkDelete: true}, 2, e, false},
+	} {
+		a := planArchiver(t, &c.config, false)
+		var bound []string
+		src := &fakeDb{exec: func(query string, args []driver.NamedValue) (int64, error) {
+			for _, arg := range args {
+				bound = append(bound, arg.Value.(string))
+			}
+			return c.deleted, nil
+		}}
+		a.src.Dbh = openFake(t.Name()+"/"+c.name, src)
+		a.ctx, a.cancel = context.WithCancel(context.Background())
+		err := a.bulkDelete(chunk)
+		a.cancel()
+		if (err == nil) != c.valid {
+			t.Errorf("%v: expected valid: %v, got %v", c.name, c.valid, err)
+		}
+		if stmts := src.statements(""); !slices.Equal(stmts, []string{c.e}) {
+			t.Errorf("%v: expected %q, got %q", c.name, c.e, stmts)
+		}
+		// The first and the last rows of the chunk
+		if e := []string{"1", "1", "1", "2", "2", "1"}; !slices.Equal(bound, e) {
+			t.Errorf("%v: expected the values %v, got %v", c.name, e, bound)
+		}
+		if c.valid && a.pending.deleted != 3 {
+			t.Errorf("%v: expected 3 rows deleted, got %d", c.name, a.pending.deleted)
+		}
+	}
+}
+
+func TestSafeAutoInc(t *testing.T) {
+	const noAutoInc = "CREATE TABLE `events` (\n" +
+		"  `id` bigint unsigned NOT NULL,\n" +
+		"  `note` varchar(64) DEFAULT NULL,\n" +
+		"  PRIMARY KEY (`id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+	for _, c := range []struct {
+		name   string
+		ddl    string
+		config Configuration
+		e      string // clause in the SELECT
+	}{
+		{"auto-increment", ordersTable, Configuration{}, " AND (`id` < 1000)"},
+		{"multi-column index", itemsTable, Configuration{}, ""},
+		{"not auto-increment", noAutoInc, Configuration{}, ""},
+		{"no-safe-auto-increment", ordersTable, Configuration{NoSafeAutoInc: true}, ""},
+	} {
+		c.config.Where = "1=1"
+		src := &fakeDb{query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+			return []string{"MAX"}, [][]driver.Value{{"1000"}}, nil
+		}}
+		a := &Archiver{config: &c.config, limit: 100, srcName: "`db`.`t`", srcTbl: parsedTable(t, c.ddl)}
+		a.src.Dbh = openFake(t.Name()+"/"+c.name, src)
+		if err := a.prepare(); err != nil {
+			t.Fatalf("%v: prepare returned an error: %v", c.name, err)
+		}
+		if a.autoIncMax != c.e {
+			t.Errorf("%v: expected the clause %q, got %q", c.name, c.e, a.autoIncMax)
+		}
+		if query := a.selectSql(""); !strings.Contains(query, "WHERE (1=1)"+c.e+" ORDER BY") {
+			t.Errorf("%v: expected the clause %q in %q", c.name, c.e, query)
+		}
+		if max := src.statements("SELECT MAX"); (len(c.e) > 0) != (len(max) > 0) {
+			t.Errorf("%v: unexpected maximum queries %v", c.name, max)
+		}
+	}
+}
+
+func TestUserCols(t *testing.T) {
+	const noPK = "CREATE TABLE `log` (\n" +
+		"  `created` datetime NOT NULL,\n" +
+		"  `msg` varchar(64) DEFAULT NULL,\n" +
+		"  KEY `created` (`created`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+	for _, c := range []struct {
+		name   string
+		ddl    string
+		config Configuration
+		e      []string
+		valid  bool
+	}{
+		{"all columns", ordersTable, Configuration{}, nil, true},
+		{"columns", ordersTable, Configuration{Columns: "note,id"}, []string{"note", "id"}, true},
+		{"backticks", ordersTable, Configuration{Columns: "`note`, `created`"}, []string{"note", "created"}, true},
+		{"duplicates", ordersTable, Configuration{Columns: "note,`note`,id,note"}, []string{"note", "id"}, true},
+		{"unknown column", ordersTable, Configuration{Columns: "note,missing"}, nil, false},
+		{"primary-key-only", ordersTable, Configuration{PrimaryKeyOnly: true}, []string{"id"}, true},
+		{"primary-key-only without primary key", noPK, Configuration{PrimaryKeyOnly: true}, nil, false},
+	} {
+		a := &Archiver{config: &c.config, srcName: "`db`.`t`", srcTbl: parsedTable(t, c.ddl)}
+		cols, err := a.userCols()
+		if (err == nil) != c.valid {
+			t.Errorf("%v: expected valid: %v, got %v", c.name, c.valid, err)
+		}
+		if !slices.Equal(cols, c.e) {
+			t.Errorf("%v: expected the columns %v, got %v", c.name, c.e, cols)
+		}
+	}
+}
+
+func TestFileColumns(t *testing.T) {
+	// The index column is fetched for the DELETE but not written
+	config := Configuration{Columns: "note,customer_id", Where: "1=1", NoSafeAutoInc: true,
+		File: filepath.Join(t.TempDir(), "rows.txt")}
+	a := &Archiver{config: &config, limit: 100, srcName: "`db`.`orders`", srcTbl: parsedTable(t, ordersTable),
+		run: newRunControl(&config, io.Discard)}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	a.src.Dbh = openFake(t.Name(), &fakeDb{})
+	a.sink = &filesink.Sink{Template: config.File}
+	if err := a.prepare(); err != nil {
+		t.Fatalf("prepare returned an error: %v", err)
+	}
+	if e := []string{"note", "customer_id", "id"}; !slices.Equal(a.selCols, e) || a.outCols != 2 {
+		t.Fatalf("Expected the columns %v with 2 written, got %v with %d", e, a.selCols, a.outCols)
+	}
+	if err := a.archiveChunk(rowsOf([]string{"first", "7", "1"}, []string{"second", "8", "2"})); err != nil {
+		t.Fatalf("archiveChunk returned an error: %v", err)
+	}
+	a.Close()
+
+	data, _ := os.ReadFile(config.File)
+	if string(data) != "first\t7\nsecond\t8\n" {
+		t.Errorf("Expected only the selected columns in the file, got %q", data)
+	}
+}
@@ -0,0 +1,381 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   The tables referencing --source with a foreign key are found in
+   information_schema. Deleting the archived rows cascades to their child
+   rows, nulls their columns or fails, depending on the ON DELETE rule, and
+   a warning tells which. With --archive-children, the child rows are
+   copied to the table of the same name in the --dest database, or purged,
+   and deleted before the rows they reference, in the same transaction.
+   Only the direct children are handled, the rows referencing them are left
+   to their own foreign keys.
+
+*/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/y-trudeau/go-toolkit/go/pkg/debug"
+	"github.com/y-trudeau/go-toolkit/go/pkg/dsn"
+	"github.com/y-trudeau/go-toolkit/go/pkg/quoter"
+	"github.com/y-trudeau/go-toolkit/go/pkg/tablenibbler"
+	"github.com/y-trudeau/go-toolkit/go/pkg/tableparser"
+
+	"go-toolkit/pkg/colcheck"
+)
+
+// maxPlaceholders is the maximum number of placeholders of a MySQL prepared
+// statement, the child rows of a large chunk are handled in batches under it.
+const maxPlaceholders = 65535
+
+// batchSize returns the number of rows of perRow placeholders each fitting
+// in a statement
+func batchSize(perRow int) int {
+	return max(1, maxPlaceholders/max(1, perRow))
+}
+
+// childTable is a table referencing --source with a foreign key
+type childTable struct {
+	fk      tableparser.FkInfo
+	db      string
+	table   string
+	name    string // backticked db.table of the child
+	info    tableparser.TableInfo
+	skip    string // why --archive-children doesn't handle it, empty if it does
+	dstName string // backticked table of the same name in the dest database
+	ins     tablenibbler.InsStmt
+	parent  []int // ordinals of the referenced columns in the fetched rows
+}
+
+// findChildren returns the foreign keys referencing the table of the DSN,
+// with the definition of their tables.
+func findChildren(d dsn.Dsn) ([]childTable, error) {
+	query := "SELECT DISTINCT TABLE_SCHEMA, TABLE_NAME, CONSTRAINT_NAME FROM information_schema.KEY_COLUMN_USAGE" +
+		" WHERE REFERENCED_TABLE_SCHEMA = ? AND REFERENCED_TABLE_NAME = ? ORDER BY 1, 2, 3"
+	rows, err := d.Dbh.Query(query, d.Database, d.Table)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find the tables referencing %v: %v",
+			quoter.Backtick([]string{d.Database, d.Table}), err)
+	}
+	var refs [][3]string
+	for rows.Next() {
+		var ref [3]string
+		if err := rows.Scan(&ref[0], &ref[1], &ref[2]); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var children []childTable
+	for _, ref := range refs {
+		c := childTable{db: ref[0], table: ref[1], name: quoter.Backtick([]string{ref[0], ref[1]})}
+		ddl, err := tableparser.GetCreateTable(d.Dbh, c.db, c.table)
+		if err != nil {
+			return nil, err
+		}
+		if c.info, err = tableparser.Parse(ddl); err != nil {
+			return nil, err
+		}
+		found := false
+		for _, fk := range tableparser.GetFks(ddl) {
+			if fk.Name() == ref[2] {
+				c.fk = fk
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Cannot find the foreign key %v in the definition of %v",
+				quoter.Backtick([]string{ref[2]}), c.name)
+		}
+
+		switch c.fk.OnDelete() {
+		case "SET NULL", "SET DEFAULT":
+			c.skip = "ON DELETE " + c.fk.OnDelete() + " keeps the child rows"
+		}
+		if c.db == d.Database && c.table == d.Table {
+			c.skip = "it references the table itself"
+		}
+		debug.Printvar("Child table", c.name+" "+c.fk.Name()+" ON DELETE "+c.fk.OnDelete())
+		children = append(children, c)
+	}
+	return children, nil
+}
+
+// warnChildren prints what deleting the archived rows does to the child
+// rows not handled by --archive-children.
+func (a *Archiver) warnChildren() {
+	if a.id != 0 || a.config.Quiet {
+		return
+	}
+	hint := false
+	for _, c := range a.children {
+		if a.config.ArchiveChildren {
+			if len(c.skip) > 0 {
+				fmt.Fprintf(os.Stderr, "The foreign key %v of %v is not handled by --archive-children, %v\n",
+					quoter.Backtick([]string{c.fk.Name()}), c.name, c.skip)
+			}
+			continue
+		}
+		effect := "deleting the referenced rows fails"
+		switch {
+		case a.config.SkipFKChecks:
+			effect = "the rows referencing the deleted rows are left orphaned"
+		case c.fk.OnDelete() == "CASCADE":
+			effect = "the rows referencing the deleted rows are deleted without being archived"
+		case c.fk.OnDelete() == "SET NULL", c.fk.OnDelete() == "SET DEFAULT":
+			effect = "the rows referencing the deleted rows are updated"
+		}
+		fmt.Fprintf(os.Stderr, "%v references %v with the foreign key %v ON DELETE %v, %v\n",
+			c.name, a.srcName, quoter.Backtick([]string{c.fk.Name()}), c.fk.OnDelete(), effect)
+		hint = hint || len(c.skip) == 0
+	}
+	if hint {
+		fmt.Fprintf(os.Stderr, "Use --archive-children to archive the child rows first\n")
+	}
+}
+
+// childParentCols returns the columns referenced by the handled children,
+// they must be fetched to find the child rows.
+func (a *Archiver) childParentCols() []string {
+	var cols []string
+	if !a.config.ArchiveChildren {
+		return cols
+	}
+	for _, c := range a.children {
+		if len(c.skip) == 0 {
+			cols = appendMissing(cols, c.fk.ParentCols())
+		}
+	}
+	return cols
+}
+
+// appendMissing appends to cols the columns of extra it doesn't contain
+func appendMissing(cols []string, extra []string) []string {
+	for _, col := range extra {
+		if !slices.Contains(cols, col) {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// prepareChildren finds the referenced columns in the fetched rows and, with
+// --dest, the tables the child rows are copied to.
+func (a *Archiver) prepareChildren() error {
+	for i := range a.children {
+		c := &a.children[i]
+		if len(c.skip) > 0 {
+			continue
+		}
+		for _, col := range c.fk.ParentCols() {
+			ord := slices.Index(a.selCols, col)
+			if ord < 0 {
+				return fmt.Errorf("The column %v referenced by %v is not fetched", quoter.Backtick([]string{col}), c.name)
+			}
+			c.parent = append(c.parent, ord)
+		}
+		if !a.hasDest {
+			continue
+		}
+
+		d := a.dst
+		d.Table = c.table
+		dstTbl, err := getTable(&d)
+		if err != nil {
+			return fmt.Errorf("Unable to get the dest table of the child rows of %v: %v", c.name, err)
+		}
+		c.dstName = quoter.Backtick([]string{d.Database, d.Table})
+		if a.config.CheckColumns {
+			if report := colcheck.Compare(c.info, c.info.GetCols(), dstTbl); report.Fatal() {
+				return fmt.Errorf("The columns of %v and %v differ:\n%v\nUse --check-columns=false to archive anyway",
+					c.name, c.dstName, report)
+			}
+		}
+		c.ins, err = tablenibbler.GenerateInsStmt(dstTbl, c.info.GetCols())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// where returns the condition matching the child rows of n parent rows
+func (c *childTable) where(n int) string {
+	row := strings.TrimRight(strings.Repeat("?,", len(c.parent)), ",")
+	if len(c.parent) > 1 {
+		row = "(" + row + ")"
+	}
+	return "(" + backtickList(c.fk.Cols()) + ") IN (" + strings.TrimRight(strings.Repeat(row+",", n), ",") + ")"
+}
+
+// selectSql returns the SELECT of the child rows of n parent rows, locked
+// until the rows are deleted.
+func (c *childTable) selectSql(n int, lock bool) string {
+	sqlStr := "SELECT " + backtickList(c.info.GetCols()) + " FROM " + c.name + " WHERE " + c.where(n)
+	if lock {
+		sqlStr = sqlStr + " FOR UPDATE"
+	}
+	return sqlStr
+}
+
+// deleteSql returns the DELETE of the child rows of n parent rows
+func (c *childTable) deleteSql(n int) string {
+	return "DELETE FROM " + c.name + " WHERE " + c.where(n)
+}
+
+// parentArgs returns the referenced values of the rows, once per distinct
+// value. The rows with a NULL value can't be referenced.
+func (c *childTable) parentArgs(rows [][]sql.NullString) ([]any, int) {
+	var args []any
+	seen := make(map[string]bool)
+	n := 0
+	for _, row := range rows {
+		vals := bindArgs(row, c.parent)
+		key := ""
+		valid := true
+		for _, v := range vals {
+			valid = valid && v.(sql.NullString).Valid
+			key = key + quoter.Quoteval(v.(sql.NullString), "char") + ","
+		}
+		if !valid || seen[key] {
+			continue
+		}
+		seen[key] = true
+		args = append(args, vals...)
+		n++
+	}
+	return args, n
+}
+
+// archiveChildren copies to dest and deletes the child rows referencing the
+// rows, before they are deleted. The parent rows are split in batches so the
+// IN lists stay under the placeholder limit.
+func (a *Archiver) archiveChildren(rows [][]sql.NullString) error {
+	for i := range a.children {
+		c := &a.children[i]
+		if len(c.skip) > 0 {
+			continue
+		}
+		args, n := c.parentArgs(rows)
+		size := batchSize(len(c.parent))
+		for start := 0; start < n; start += size {
+			end := min(n, start+size)
+			if err := a.archiveChildBatch(c, args[start*len(c.parent):end*len(c.parent)], end-start); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveChildBatch copies and deletes the child rows of n parent rows.
+// Without a transaction, a child row inserted after the SELECT would be
+// deleted without being copied, the number of rows deleted is checked so it
+// is rolled back instead.
+func (a *Archiver) archiveChildBatch(c *childTable, args []any, n int) error {
+	var copied [][]sql.NullString
+	if a.hasDest {
+		var err error
+		GenStats(a.config, "SELECT_CHILDREN", func() {
+			copied, err = a.srcRows(c.selectSql(n, a.transactional()), len(c.info.GetCols()), args...)
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to select the child rows of %v: %w", c.name, err)
+		}
+		if len(copied) > 0 {
+			GenStats(a.config, "INSERT_CHILDREN", func() {
+				err = a.insertChildren(c, copied)
+			})
+			if err != nil {
+				return fmt.Errorf("Unable to insert the child rows in %v: %w", c.dstName, err)
+			}
+		}
+	}
+
+	var res sql.Result
+	var err error
+	GenStats(a.config, "DELETE_CHILDREN", func() {
+		res, err = a.srcExec(c.deleteSql(n), args...)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to delete the child rows of %v: %w", c.name, err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if a.hasDest && deleted != int64(len(copied)) {
+		return fmt.Errorf("Deleted %d child rows from %v but %d rows were copied to %v, rolling back",
+			deleted, c.name, len(copied), c.dstName)
+	}
+	AddStat("children_deleted", deleted)
+	return nil
+}
+
+// insertSql returns the INSERT of n child rows in dest
+func (c *childTable) insertSql(verb string, n int) string {
+	row := "(" + strings.TrimRight(strings.Repeat("?,", len(c.ins.Cols)), ",") + ")"
+	return verb + " INTO " + c.dstName + " (" + backtickList(c.ins.Cols) + ") VALUES " +
+		strings.TrimRight(strings.Repeat(row+",", n), ",")
+}
+
+// insertChildren inserts the child rows in dest, with a single statement
+// unless they exceed the placeholder limit.
+func (a *Archiver) insertChildren(c *childTable, rows [][]sql.NullString) error {
+	size := batchSize(len(c.ins.Cols))
+	for start := 0; start < len(rows); start += size {
+		batch := rows[start:min(len(rows), start+size)]
+		var args []any
+		for _, r := range batch {
+			args = append(args, bindArgs(r, c.ins.Slice)...)
+		}
+		if _, err := a.dstExec(c.insertSql(a.insertVerb(), len(batch)), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// childrenPlan returns the statements of --archive-children run before
+// deleting the rows, shown for a single parent row.
+func (a *Archiver) childrenPlan(from string) []planStmt {
+	var stmts []planStmt
+	for _, c := range a.children {
+		if len(c.skip) > 0 {
+			continue
+		}
+		parent := binds(c.fk.ParentCols(), from)
+		if a.hasDest {
+			stmts = append(stmts,
+				planStmt{"SELECT of the child rows in " + c.name, c.selectSql(1, a.transactional()), parent},
+				planStmt{"INSERT of the child rows in " + c.dstName + ", one (...) per child row",
+					c.insertSql(a.insertVerb(), 1), binds(c.ins.Cols, "child row")})
+		}
+		stmts = append(stmts, planStmt{"DELETE of the child rows in " + c.name, c.deleteSql(1), parent})
+	}
+	return stmts
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/y-trudeau/go-toolkit/go/pkg/tablenibbler"
+	"github.com/y-trudeau/go-toolkit/go/pkg/tableparser"
+)
+
+// linesTable references the orders with a single column
+const linesTable = "CREATE TABLE `lines` (\n" +
+	"  `id` int NOT NULL,\n" +
+	"  `order_id` bigint unsigned NOT NULL,\n" +
+	"  `sku` varchar(32) NOT NULL,\n" +
+	"  PRIMARY KEY (`id`),\n" +
+	"  KEY `order_idx` (`order_id`),\n" +
+	"  CONSTRAINT `lines_order` FOREIGN KEY (`order_id`) REFERENCES `orders` (`id`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// shipmentsTable references the orders with two columns
+const shipmentsTable = "CREATE TABLE `shipments` (\n" +
+	"  `id` int NOT NULL,\n" +
+	"  `customer` int NOT NULL,\n" +
+	"  `order_id` bigint unsigned NOT NULL,\n" +
+	"  PRIMARY KEY (`id`),\n" +
+	"  KEY `order_idx` (`customer`,`order_id`),\n" +
+	"  CONSTRAINT `shipments_order` FOREIGN KEY (`customer`,`order_id`) REFERENCES `orders` (`customer_id`,`id`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// child returns the child table `db`.table of ddl, the referenced columns
+// read from the rows at the parent ordinals.
+func child(t *testing.T, table string, ddl string, parent ...int) childTable {
+	t.Helper()
+	c := childTable{db: "db", table: table, name: "`db`.`" + table + "`", info: parsedTable(t, ddl), parent: parent}
+	for _, fk := range tableparser.GetFks(ddl) {
+		c.fk = fk
+	}
+	return c
+}
+
+func TestChildSql(t *testing.T) {
+	lines := child(t, "lines", linesTable, 0)
+	shipments := child(t, "shipments", shipmentsTable, 1, 0)
+	for _, c := range []struct {
+		c     childTable
+		n     int
+		lock  bool
+		where string
+		sel   string
+	}{
+		{lines, 1, false, "(`order_id`) IN (?)", "SELECT `id`,`order_id`,`sku` FROM `db`.`lines` WHERE (`order_id`) IN (?)"},
+		{lines, 3, true, "(`order_id`) IN (?,?,?)",
+			"SELECT `id`,`order_id`,`sku` FROM `db`.`lines` WHERE (`order_id`) IN (?,?,?) FOR UPDATE"},
+		{shipments, 1, true, "(`customer`,`order_id`) IN ((?,?))",
+			"SELECT `id`,`customer`,`order_id` FROM `db`.`shipments` WHERE (`customer`,`order_id`) IN ((?,?)) FOR UPDATE"},
+		{shipments, 2, false, "(`customer`,`order_id`) IN ((?,?),(?,?))",
+			"SELECT `id`,`customer`,`order_id` FROM `db`.`shipments` WHERE (`customer`,`order_id`) IN ((?,?),(?,?))"},
+	} {
+		if w := c.c.where(c.n); w != c.where {
+			t.Errorf("where(%d): expected %q, got %q", c.n, c.where, w)
+		}
+		if s := c.c.selectSql(c.n, c.lock); s != c.sel {
+			t.Errorf("selectSql(%d, %v): expected %q, got %q", c.n, c.lock, c.sel, s)
+		}
+	}
+}
+
+func TestParentArgs(t *testing.T) {
+	// Rows of the orders: id, customer_id
+	rows := rowsOf([]string{"1", "10"}, []string{"2", "10"}, []string{"1", "10"}, []string{"3", "20"}, []string{"2", "30"})
+	rows = append(rows, []sql.NullString{{}, {String: "10", Valid: true}})
+	val := func(s string) sql.NullString { return sql.NullString{String: s, Valid: true} }
+	{
+		// Single column, duplicates and NULL skipped
+		lines := child(t, "lines", linesTable, 0)
+		args, n := lines.parentArgs(rows)
+		e := []any{val("1"), val("2"), val("3")}
+		if n != 3 || !slices.Equal(args, e) {
+			t.Errorf("Single column: expected %d %v, got %d %v", 3, e, n, args)
+		}
+	}
+	{
+		// Composite, in the order of the foreign key
+		shipments := child(t, "shipments", shipmentsTable, 1, 0)
+		args, n := shipments.parentArgs(rows)
+		e := []any{val("10"), val("1"), val("10"), val("2"), val("20"), val("3"), val("30"), val("2")}
+		if n != 4 || !slices.Equal(args, e) {
+			t.Errorf("Composite: expected %d %v, got %d %v", 4, e, n, args)
+		}
+	}
+}
+
+func TestArchiveChildrenBatches(t *testing.T) {
+	// Enough parent rows to exceed the placeholders of a statement
+	var rows [][]string
+	for i := range maxPlaceholders + 1 {
+		rows = append(rows, []string{strconv.Itoa(i), strconv.Itoa(i % 7)})
+	}
+	for _, c := range []struct {
+		name    string
+		child   childTable
+		batches []int
+	}{
+		{"single", child(t, "lines", linesTable, 0), []int{65535, 1}},
+		// 32767 pairs per DELETE
+		{"composite", child(t, "shipments", shipmentsTable, 1, 0), []int{65534, 65534, 4}},
+	} {
+		var batches []int
+		src := &fakeDb{exec: func(query string, args []driver.NamedValue) (int64, error) {
+			if strings.Count(query, "?") != len(args) {
+				t.Errorf("%v: %d placeholders for %d arguments", c.name, strings.Count(query, "?"), len(args))
+			}
+			batches = append(batches, len(args))
+			return 0, nil
+		}}
+		config := Configuration{Purge: true}
+		a := fakeArchiver(t, &config, src, &fakeDb{})
+		a.hasDest = false
+		a.children = []childTable{c.child}
+		if err := a.archiveChildren(rowsOf(rows...)); err != nil {
+			t.Fatalf("%v: archiveChildren returned an error: %v", c.name, err)
+		}
+		if !slices.Equal(batches, c.batches) {
+			t.Errorf("%v: expected DELETE batches of %v placeholders, got %v", c.name, c.batches, batches)
+		}
+		a.Close()
+	}
+}
+
+func TestInsertChildrenBatches(t *testing.T) {
+	var batches []int
+	dst := &fakeDb{exec: func(query string, args []driver.NamedValue) (int64, error) {
+		batches = append(batches, len(args))
+		return int64(len(args) / 3), nil
+	}}
+	a := fakeArchiver(t, &Configuration{}, &fakeDb{}, dst)
+	c := child(t, "lines", linesTable, 0)
+	c.dstName = "`arch`.`lines`"
+	c.ins = tablenibbler.InsStmt{Cols: []string{"id", "order_id", "sku"}, Slice: []int{0, 1, 2}}
+	var rows [][]string
+	for i := range 50000 {
+		rows = append(rows, []string{strconv.Itoa(i), "1", "a"})
+	}
+	if err := a.insertChildren(&c, rowsOf(rows...)); err != nil {
+		t.Fatalf("insertChildren returned an error: %v", err)
+	}
+	// 21845 rows of 3 columns per INSERT
+	e := []int{65535, 65535, 18930}
+	if !slices.Equal(batches, e) {
+		t.Errorf("Expected INSERT batches of %v placeholders, got %v", e, batches)
+	}
+	a.Close()
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   With --dry-run, the statements a run would execute are printed with the
+   columns bound to their placeholders, and nothing is executed. The plan
+   is a valid SQL script, the explanations being comments.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// planStmt is a statement of the plan
+type planStmt struct {
+	title string
+	sql   string
+	binds []planBind // one per placeholder
+}
+
+// planBind is the column bound to a placeholder and the row it is read from
+type planBind struct {
+	col  string
+	from string
+}
+
+// binds returns the binds of cols read from the same row
+func binds(cols []string, from string) []planBind {
+	b := make([]planBind, len(cols))
+	for i, col := range cols {
+		b[i] = planBind{col, from}
+	}
+	return b
+}
+
+// plan returns the statements of the run in their execution order
+func (a *Archiver) plan() []planStmt {
+	var stmts []planStmt
+	var upper []planBind
+	if a.upper != nil {
+		upper = binds(a.rangeAsc.Scols, "upper bound of the worker")
+	}
+
+	first := planStmt{title: "First SELECT", sql: a.selectSql("")}
+	if a.lower != nil {
+		first = planStmt{"First SELECT", a.selectSql(a.rangeAsc.Boundaries[">="]),
+			binds(a.rangeAsc.Scols, "lower bound of the worker")}
+	}
+	first.binds = append(first.binds, upper...)
+	stmts = append(stmts, first)
+	if a.config.Resume {
+		stmts = append(stmts, planStmt{"First SELECT when a checkpoint is found", a.selectSql(a.asc.Boundaries[">"]),
+			append(binds(a.asc.Scols, "checkpoint"), upper...)})
+	}
+
+	if !a.config.NoAscend {
+		stmts = append(stmts, planStmt{"Next SELECT", a.selectSql(a.asc.Where),
+			append(binds(a.asc.Scols, "last row fetched"), upper...)})
+	}
+
+	if a.hasDest {
+		if a.config.InsertSelect {
+			stmts = append(stmts, planStmt{"INSERT ... SELECT of the chunk, on the source", a.insertSelectSql(),
+				append(binds(a.asc.Scols, "first row of the chunk"), binds(a.asc.Scols, "last row of the chunk")...)})
+		} else if a.config.BulkInsert {
+			stmts = append(stmts, planStmt{title: "Bulk INSERT of the chunk, columns in the file: " +
+				backtickList(a.ins.Cols), sql: a.bulkSql})
+		} else {
+			stmts = append(stmts, planStmt{"INSERT", a.insSql, binds(a.ins.Cols, "row")})
+		}
+		if len(a.verifySql) > 0 {
+			stmts = append(stmts, planStmt{"Verify the archived row in dest", a.verifySql, binds(a.del.Scols, "row")})
+		}
+	}
+
+	if !a.config.NoDelete {
+		if a.config.ArchiveChildren {
+			from := "row"
+			if a.config.BulkDelete {
+				from = "row, the IN list repeated for each row of the chunk"
+			}
+			stmts = append(stmts, a.childrenPlan(from)...)
+		}
+		if a.config.BulkDelete {
+			stmts = append(stmts, planStmt{"Bulk DELETE of the chunk", a.bulkDeleteSql(),
+				append(binds(a.asc.Scols, "first row of the chunk"), binds(a.asc.Scols, "last row of the chunk")...)})
+		} else {
+			stmts = append(stmts, planStmt{"DELETE", a.delSql, binds(a.del.Scols, "row")})
+		}
+	}
+
+	for _, stmt := range a.maintenanceSql() {
+		server := "the source"
+		if stmt.dest {
+			server = "dest"
+		}
+		title := "After the run, on " + server
+		if len(stmt.skip) > 0 {
+			title = title + ", skipped: " + stmt.skip
+		}
+		stmts = append(stmts, planStmt{title: title, sql: stmt.sql})
+	}
+	return stmts
+}
+
+// printPlan prints the statements, each one preceded by comments with the
+// columns bound to its placeholders.
+func printPlan(w io.Writer, stmts []planStmt) {
+	for _, stmt := range stmts {
+		fmt.Fprintf(w, "-- %v\n", stmt.title)
+		// Consecutive placeholders read from the same row are grouped
+		for i := 0; i < len(stmt.binds); {
+			j := i
+			var cols []string
+			for ; j < len(stmt.binds) && stmt.binds[j].from == stmt.binds[i].from; j++ {
+				cols = append(cols, stmt.binds[j].col)
+			}
+			placeholders := fmt.Sprintf("?%d", i+1)
+			if j > i+1 {
+				placeholders = fmt.Sprintf("?%d-?%d", i+1, j)
+			}
+			fmt.Fprintf(w, "-- %v: %v of the %v\n", placeholders, backtickList(cols), stmt.binds[i].from)
+			i = j
+		}
+		fmt.Fprintf(w, "%v;\n\n", stmt.sql)
+	}
+}
+
+// DryRun prints the plan of each worker
+func (p *WorkerPool) DryRun(w io.Writer) {
+	for i, a := range p.workers {
+		if len(p.workers) > 1 {
+			fmt.Fprintf(w, "-- Worker %d\n", i)
+		}
+		printPlan(w, a.plan())
+	}
+}
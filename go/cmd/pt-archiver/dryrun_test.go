@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// itemsTable has a composite primary key, the placeholders of its
+// boundaries are grouped in the plan.
+const itemsTable = "CREATE TABLE `items` (\n" +
+	"  `order_id` int unsigned NOT NULL,\n" +
+	"  `line` smallint NOT NULL,\n" +
+	"  `sku` varchar(32) NOT NULL,\n" +
+	"  `qty` int DEFAULT NULL,\n" +
+	"  PRIMARY KEY (`order_id`,`line`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// planArchiver returns an archiver of `db`.`items` prepared like with
+// --dry-run, to `arch`.`items` when dest is true.
+func planArchiver(t *testing.T, config *Configuration, dest bool) *Archiver {
+	config.Where = "1=1"
+	config.Limit = 100
+	config.NoSafeAutoInc = true
+	a := &Archiver{config: config, limit: config.Limit, srcName: "`db`.`items`", srcTbl: parsedTable(t, itemsTable)}
+	if dest {
+		a.hasDest = true
+		a.dstName = "`arch`.`items`"
+		a.dstTbl = parsedTable(t, itemsTable)
+	}
+	if err := a.prepare(); err != nil {
+		t.Fatalf("prepare returned an error: %v", err)
+	}
+	return a
+}
+
+func TestPrintPlan(t *testing.T) {
+	{
+		// Only consecutive placeholders of the same row are grouped
+		var buf bytes.Buffer
+		printPlan(&buf, []planStmt{{"Test", "SELECT ?, ?, ?, ?", []planBind{{"a", "row"}, {"b", "row"}, {"c", "bound"}, {"d", "row"}}}})
+		e := "-- Test\n" +
+			"-- ?1-?2: `a`,`b` of the row\n" +
+			"-- ?3: `c` of the bound\n" +
+			"-- ?4: `d` of the row\n" +
+			"SELECT ?, ?, ?, ?;\n\n"
+		if buf.String() != e {
+			t.Errorf("Grouping: expected\n%v\ngot\n%v", e, buf.String())
+		}
+	}
+	{
+		// A worker with both bounds, the statements in their execution order
+		a := planArchiver(t, &Configuration{BulkDelete: true, VerifyDest: true, Analyze: "sd", Optimize: "s"}, true)
+		lower, upper := "1000", "2000"
+		if err := a.setRange(&lower, &upper); err != nil {
+			t.Fatalf("setRange returned an error: %v", err)
+		}
+		var buf bytes.Buffer
+		printPlan(&buf, a.plan())
+		e := "-- First SELECT\n" +
+			"-- ?1: `order_id` of the lower bound of the worker\n" +
+			"-- ?2: `order_id` of the upper bound of the worker\n" +
+			"SELECT /*!40001 SQL_NO_CACHE */ `order_id`,`line`,`sku`,`qty` FROM `db`.`items` FORCE INDEX(`PRIMARY`) " +
+			"WHERE (1=1) AND ((`order_id` >= ?)) AND ((`order_id` < ?)) ORDER BY `order_id`,`line` LIMIT 100;\n\n" +
+			"-- Next SELECT\n" +
+			"-- ?1-?3: `order_id`,`order_id`,`line` of the last row fetched\n" +
+			"-- ?4: `order_id` of the upper bound of the worker\n" +
+			"SELECT /*!40001 SQL_NO_CACHE */ `order_id`,`line`,`sku`,`qty` FROM `db`.`items` FORCE INDEX(`PRIMARY`) " +
+			"WHERE (1=1) AND ((`order_id` > ?) OR (`order_id` = ? AND `line` > ?)) AND ((`order_id` < ?)) " +
+			"ORDER BY `order_id`,`line` LIMIT 100;\n\n" +
+			"-- INSERT\n" +
+			"-- ?1-?4: `order_id`,`line`,`sku`,`qty` of the row\n" +
+			"INSERT INTO `arch`.`items` (`order_id`,`line`,`sku`,`qty`) VALUES (?,?,?,?);\n\n" +
+			"-- Verify the archived row in dest\n" +
+			"-- ?1-?2: `order_id`,`line` of the row\n" +
+			"SELECT `order_id`,`line`,`sku`,`qty` FROM `arch`.`items` WHERE (`order_id` = ? AND `line` = ?) LIMIT 1;\n\n" +
+			"-- Bulk DELETE of the chunk\n" +
+			"-- ?1-?3: `order_id`,`order_id`,`line` of the first row of the chunk\n" +
+			"-- ?4-?6: `order_id`,`order_id`,`line` of the last row of the chunk\n" +
+			"DELETE FROM `db`.`items` WHERE ((`order_id` > ?) OR (`order_id` = ? AND `line` >= ?)) " +
+			"AND ((`order_id` < ?) OR (`order_id` = ? AND `line` <= ?)) AND (1=1);\n\n" +
+			"-- After the run, on the source\n" +
+			"ANALYZE TABLE `db`.`items`;\n\n" +
+			"-- After the run, on dest\n" +
+			"ANALYZE TABLE `arch`.`items`;\n\n" +
+			"-- After the run, on the source, skipped: it rebuilds the InnoDB table, use --force-optimize to run it\n" +
+			"OPTIMIZE TABLE `db`.`items`;\n\n"
+		if buf.String() != e {
+			t.Errorf("Worker plan: expected\n%v\ngot\n%v", e, buf.String())
+		}
+	}
+	{
+		// --resume without dest
+		a := planArchiver(t, &Configuration{Resume: true}, false)
+		var buf bytes.Buffer
+		printPlan(&buf, a.plan())
+		e := "-- First SELECT\n" +
+			"SELECT /*!40001 SQL_NO_CACHE */ `order_id`,`line`,`sku`,`qty` FROM `db`.`items` FORCE INDEX(`PRIMARY`) " +
+			"WHERE (1=1) ORDER BY `order_id`,`line` LIMIT 100;\n\n" +
+			"-- First SELECT when a checkpoint is found\n" +
+			"-- ?1-?3: `order_id`,`order_id`,`line` of the checkpoint\n" +
+			"SELECT /*!40001 SQL_NO_CACHE */ `order_id`,`line`,`sku`,`qty` FROM `db`.`items` FORCE INDEX(`PRIMARY`) " +
+			"WHERE (1=1) AND ((`order_id` > ?) OR (`order_id` = ? AND `line` > ?)) ORDER BY `order_id`,`line` LIMIT 100;\n\n" +
+			"-- Next SELECT\n" +
+			"-- ?1-?3: `order_id`,`order_id`,`line` of the last row fetched\n" +
+			"SELECT /*!40001 SQL_NO_CACHE */ `order_id`,`line`,`sku`,`qty` FROM `db`.`items` FORCE INDEX(`PRIMARY`) " +
+			"WHERE (1=1) AND ((`order_id` > ?) OR (`order_id` = ? AND `line` > ?)) ORDER BY `order_id`,`line` LIMIT 100;\n\n" +
+			"-- DELETE\n" +
+			"-- ?1-?2: `order_id`,`line` of the row\n" +
+			"DELETE FROM `db`.`items` WHERE (`order_id` = ? AND `line` = ?);\n\n"
+		if buf.String() != e {
+			t.Errorf("Resume plan: expected\n%v\ngot\n%v", e, buf.String())
+		}
+	}
+}
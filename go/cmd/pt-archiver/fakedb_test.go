@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// fakeDb is a database/sql driver recording the statements, the tests decide
+// what each statement returns.
+type fakeDb struct {
+	mu    sync.Mutex
+	execs []string // statements executed, COMMIT and ROLLBACK included
+	// exec returns the rows affected by a statement or an error, nil means 1 row
+	exec func(query string, args []driver.NamedValue) (int64, error)
+	// query returns the columns and the rows of a SELECT, nil means no rows
+	query func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error)
+	// commit returns the error of a COMMIT, nil means it succeeds
+	commit func() error
+}
+
+var fakeDbs sync.Map
+
+type fakeDriver struct{}
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// openFake returns a connection pool to db
+func openFake(name string, db *fakeDb) *sql.DB {
+	fakeDbs.Store(name, db)
+	dbh, _ := sql.Open("fakedb", name)
+	return dbh
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	db, ok := fakeDbs.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("Unknown fake database %v", name)
+	}
+	return &fakeConn{db.(*fakeDb)}, nil
+}
+
+// statements returns the executed statements starting with prefix
+func (db *fakeDb) statements(prefix string) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var stmts []string
+	for _, s := range db.execs {
+		if strings.HasPrefix(s, prefix) {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts
+}
+
+func (db *fakeDb) record(query string) {
+	db.mu.Lock()
+	db.execs = append(db.execs, query)
+	db.mu.Unlock()
+}
+
+type fakeConn struct {
+	db *fakeDb
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("Prepare is not supported")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.record("COMMIT")
+	if c.db.commit != nil {
+		return c.db.commit()
+	}
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.db.record("ROLLBACK")
+	return nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.record(query)
+	n := int64(1)
+	if c.db.exec != nil {
+		var err error
+		if n, err = c.db.exec(query, args); err != nil {
+			return nil, err
+		}
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.record(query)
+	var cols []string
+	var rows [][]driver.Value
+	if c.db.query != nil {
+		var err error
+		if cols, rows, err = c.db.query(query, args); err != nil {
+			return nil, err
+		}
+	}
+	return &fakeRows{cols: cols, rows: rows}, nil
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
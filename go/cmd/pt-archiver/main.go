@@ -27,17 +27,20 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"regexp"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/y-trudeau/go-toolkit/go/dsn"
+	"github.com/y-trudeau/go-toolkit/go/pkg/dsn"
+
+	"go-toolkit/pkg/sentinel"
 )
 
 var bDebug = false
 
 type Configuration struct {
 	Analyze         string // Run ANALYZE TABLE afterwards on --source (s) and/or --dest (d).
+	ArchiveChildren bool   // Archive the rows of the tables referencing --source before their parent rows.
 	AscendFirst     bool   // Ascend only first column of index.
 	AskPass         bool   // Prompt for a password when connecting to MySQL.
 	Buffer          bool   // Buffer output to --file and flush at commit.
@@ -46,8 +49,10 @@ type Configuration struct {
 	BulkInsert      bool   // Insert each chunk with LOAD DATA INFILE (implies --bulk-delete --commit-each).
 	Channel         string // Replication channel to use
 	CheckColumns    bool   // Ensure --source and --dest have same columns.
+	CheckpointFile  string // File where the boundary of the last committed chunk is saved.
+	CheckpointTable string // Table where the boundary of the last committed chunk is saved.
 	CheckTime       int    // If --check-slave-lag is given, this defines how long the tool pauses (in seconds) each time it discovers
-	// that a slave is lagging. This check is performed every 100 rows.
+	// that a slave is lagging. This check is performed between chunks.
 	CheckSlaveLag string // Pause archiving until the specified DSN's slave lag is less than --max-lag.
 	// Multiple DSN can be provided when seperated by ';'
 	Columns      string // Comma-separated list of columns to archive.
@@ -58,27 +63,36 @@ type Configuration struct {
 	ForUpdate    bool   // Adds the FOR UPDATE modifier to SELECT statements.
 	Header       bool   // Print column header at top of --file.
 	Ignore       bool   // Use IGNORE for INSERT statements.
+	InsertSelect bool   // Copy each chunk with INSERT ... SELECT when --dest is on the same server.
 	Limit        int    // Number of rows to fetch and archive per statement.
 	Local        bool   // Do not write OPTIMIZE or ANALYZE queries to binlog.
-	MaxFlowCtl   int    // Max Percentage of time spent doing flow
+	MaxFlowCtl   int    // Max percentage of time a Galera node can be paused by flow control, 0 disables the check
 	MaxLag       int    // Pause archiving if the slave given by --check-slave-lag lag(s) Default: 1
 	NoAscend     bool   // Do not use acending index optimization
 	NoDelete     bool   // Do not delete the archived rows
+	NoWait       bool   // Adds NOWAIT to --for-update or --share-lock.
 	Optimize     string // Run OPTIMIZE TABLE afterwards on --source (s) and/or --dest (d)
 	OutputFormat string // Used with --file to specify the output format
 	// Valid formats are:
 	// dump: MySQL dump format using tabs as field separator (default)
 	// csv : Dump rows using ',' as separator and optionally enclosing fields by '"'.
 	//		This format is equivalent to FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '"'. `)
+	FileMaxSize    int64         // Rotate --file once it exceeds this size in bytes, 0 disables.
+	FileRotate     bool          // Rotate --file when its expanded name changes.
+	ForceOptimize  bool          // Run --optimize on InnoDB tables, which are rebuilt.
 	Pid            string        // Create the given PID file.
-	Plugin         string        // Path of Golang .so library to use as plugin (see: https://pkg.go.dev/plugin)
+	Plugin         string        // Path of Golang .so library, or name of a compiled in plugin (see: pkg/archiverplugin)
 	PrimaryKeyOnly bool          // Primary key columns only
 	Progress       int           // Print progress information every X rows
 	Purge          bool          // Purge instead of archiving
 	Quiet          bool          // Do not print any output, such as for --statistics.
 	Replace        bool          // Causes INSERTs into --dest to be written as REPLACE.
 	Retries        int           // Number of retries per timeout or deadlock.
+	Resume         bool          // Resume after the boundary saved in the checkpoint.
 	RunTime        time.Duration // Time to run before exiting in golang time.Duration format.
+	ChunkTime      time.Duration // Adjust --limit so each chunk takes this time, 0 disables.
+	ChunkSizeMin   int           // Minimum chunk size with --chunk-time.
+	ChunkSizeMax   int           // Maximum chunk size with --chunk-time, 0 means no maximum.
 	NoSafeAutoInc  bool          // Disable the auto-increment safety checks.
 	StopSentinel   string        // Exit if the file exists.
 	PauseSentinel  string        // Pause if the file exists.
@@ -86,6 +100,7 @@ type Configuration struct {
 	SlavePassword  string        // Sets the password to be used to connect to the slaves.
 	ShareLock      bool          // Adds the LOCK IN SHARE MODE modifier to SELECT statements.
 	SkipFKChecks   bool          // Disables foreign key checks with SET FOREIGN_KEY_CHECKS=0.
+	SkipLocked     bool          // Adds SKIP LOCKED to --for-update or --share-lock.
 	SleepTime      time.Duration // Time to sleep between fetches in golang time.Duration format.
 	SleepCoef      float64       // Calculate --sleep as a multiple of the last SELECT time
 	Source         string        // DSN specifying the table to archive from.
@@ -94,45 +109,66 @@ type Configuration struct {
 	Pause          bool          // Pause running instances by creating the Pause sentinel file.
 	UnPause        bool          // Unpause running instances by removing the Pause sentinel file.
 	TxnSize        int           // Number of rows per transaction (default = 1).
+	VerifyDest     bool          // Check the archived rows are in --dest before deleting them.
 	Version        bool          // Print the version and exit.
 	Where          string        // WHERE clause to limit which rows to archive (required).
 	WhyQuit        bool          // Print reason for exiting unless rows exhausted.
+	Workers        int           // Number of workers archiving disjoint ranges of the index.
 
 }
 
 var Config Configuration
 var Statistics map[string]int64
+var statsLock sync.Mutex // the --workers share the Statistics
 
 func (config *Configuration) init() {
 	defaultZeroTime, _ := time.ParseDuration("0")
 
 	flag.StringVar(&config.Analyze, "analyze", "", "Run ANALYZE TABLE afterwards on --source and/or --dest.")
+	flag.BoolVar(&Config.ArchiveChildren, "archive-children", false, `Archive the rows of the tables referencing --source with a foreign key before deleting
+   the rows they reference: they are copied to the table of the same name in the --dest database, or purged.`)
 	flag.BoolVar(&config.AscendFirst, "ascent-first", false, "Ascend only first column of index.")
 	flag.BoolVar(&Config.AskPass, "ask-pass", false, "Prompt for a password when connecting to MySQL.")
-	flag.BoolVar(&Config.Buffer, "buffer", false, "Buffer output to --file and flush at commit.")
+	flag.BoolVar(&Config.Buffer, "buffer", false, "Buffer output to --file and flush at commit. The file is synced at each commit.")
 	flag.BoolVar(&Config.BulkDelete, "bulk-delete", false, "Delete each chunk with a single statement (implies --commit-each).")
 	flag.BoolVar(&Config.BulkDeleteLimit, "bulk-delete-limit", true, "Add --limit to --bulk-delete statement")
 	flag.BoolVar(&Config.BulkInsert, "bulk-insert", false, "Insert each chunk with LOAD DATA INFILE (implies --bulk-delete --commit-each).")
 	flag.StringVar(&config.Channel, "channel", "", "Replication channel to monitor")
-	flag.BoolVar(&Config.CheckColumns, "check-columns", true, "Ensure --source and --dest have same columns.")
+	flag.BoolVar(&Config.CheckColumns, "check-columns", true, "Ensure the --dest columns can hold the archived --source columns, --check-columns=false to skip.")
+	flag.StringVar(&Config.CheckpointFile, "checkpoint-file", "", "Save the boundary of the last committed chunk to this file, see --resume.")
+	flag.StringVar(&Config.CheckpointTable, "checkpoint-table", "", `Save the boundary of the last committed chunk to this table (db.tbl), on the --source
+   server. The table is created if it doesn't exist, see --resume.`)
+	flag.DurationVar(&Config.ChunkTime, "chunk-time", defaultZeroTime, `Adjust the number of rows per chunk so each chunk (SELECT, INSERT and DELETE) takes this time,
+   in golang time.Duration format. --limit is the size of the first chunk. 0 disables.`)
+	flag.IntVar(&Config.ChunkSizeMin, "chunk-size-min", 1, "Minimum number of rows per chunk with --chunk-time.")
+	flag.IntVar(&Config.ChunkSizeMax, "chunk-size-max", 0, "Maximum number of rows per chunk with --chunk-time, 0 means no maximum.")
 	flag.IntVar(&Config.CheckTime, "check-interval", 1, `If --check-slave-lag is given, this defines how long the tool pauses (in seconds) each time it discovers
-   that a slave is lagging. This check is performed every 100 rows.`)
+   that a slave is lagging. This check is performed between chunks.`)
 	flag.StringVar(&Config.CheckSlaveLag, "check-slave-lag", "", `Pause archiving until the specified DSN's slave lag is less than --max-lag.
    Multiple DSN can be provided when seperated by ';'`)
 	flag.StringVar(&Config.Columns, "columns", "", "Comma-separated list of columns to archive.")
 	flag.BoolVar(&Config.CommitEach, "commit-each", false, "Commit each set of fetched and archived rows (disables --txn-size).")
 	flag.StringVar(&Config.Dest, "dest", "", "DSN specifying the table to archive to.")
 	flag.BoolVar(&Config.DryRun, "dry-run", false, "Print queries and exit without doing anything.")
-	flag.StringVar(&Config.File, "file", "", "File to archive to, with DATE_FORMAT()-like formatting, support ['%d','%H','%i','%m','%s','%Y'].")
+	flag.StringVar(&Config.File, "file", "", `File to archive to, with DATE_FORMAT()-like formatting, support ['%d','%H','%i','%m','%s','%Y']
+   and '%D', '%t' for the database and table names. Compressed with gzip when ending with .gz and zstd with .zst.`)
+	flag.Int64Var(&Config.FileMaxSize, "file-max-size", 0, "Rotate --file at commit once it exceeds this size in bytes, 0 disables.")
+	flag.BoolVar(&Config.FileRotate, "file-rotate", false, `Rotate --file at commit when its expanded name changes, every hour with %H
+   for example.`)
+	flag.BoolVar(&Config.ForceOptimize, "force-optimize", false, "Run --optimize on InnoDB tables, where OPTIMIZE TABLE rebuilds the whole table.")
 	flag.BoolVar(&Config.ForUpdate, "for-update", false, "Adds the FOR UPDATE modifier to SELECT statements.")
 	flag.BoolVar(&Config.Header, "header", false, "Print column header at top of --file.")
 	flag.BoolVar(&Config.Ignore, "ignore", false, "Use IGNORE for INSERT statements.")
+	flag.BoolVar(&Config.InsertSelect, "insert-select", false, `Copy each chunk with a single INSERT ... SELECT, run on --source, when --dest is on the
+   same server, checked with @@server_uuid. Only the index columns are fetched (implies --bulk-delete --commit-each).`)
 	flag.IntVar(&Config.Limit, "limit", 1, "Number of rows to fetch and archive per statement.")
 	flag.BoolVar(&Config.Local, "local", false, "Do not write OPTIMIZE or ANALYZE queries to binlog.")
-	flag.IntVar(&Config.MaxFlowCtl, "max-flow-ctl", 1, "Number of rows to fetch and archive per statement.")
+	flag.IntVar(&Config.MaxFlowCtl, "max-flow-ctl", 0, `Pause archiving while the --source Galera/PXC node is paused by flow control
+   more than this percentage of the time, checked between chunks. 0 disables the check.`)
 	flag.IntVar(&Config.MaxLag, "max-lag", 1, "Pause archiving if the slave given by --check-slave-lag lags.). Default: 1s")
 	flag.BoolVar(&Config.NoAscend, "no-ascend", false, "Do not use acending index optimization")
 	flag.BoolVar(&Config.NoDelete, "no-delete", false, "Do not delete the archived rows")
+	flag.BoolVar(&Config.NoWait, "nowait", false, "Adds NOWAIT to --for-update or --share-lock, failing instead of waiting for locked rows. Requires MySQL 8.0.1.")
 	flag.StringVar(&Config.Optimize, "optimize", "", "Run OPTIMIZE TABLE afterwards on --source and/or --dest")
 	flag.StringVar(&Config.OutputFormat, "output-format", "dump", `Used with --file to specify the output format.
 
@@ -141,37 +177,45 @@ func (config *Configuration) init() {
    csv : Dump rows using ',' as separator and optionally enclosing fields by '"'.
          This format is equivalent to FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '"'. `)
 	flag.StringVar(&Config.Pid, "pid", "", "Create the given PID file.")
-	flag.StringVar(&Config.Plugin, "plugin", "", "Golang .so library to use as plugin.") // https://pkg.go.dev/plugin
+	flag.StringVar(&Config.Plugin, "plugin", "", "Golang .so library, or name of a compiled in plugin, to use as plugin.") // https://pkg.go.dev/plugin
 	flag.BoolVar(&Config.PrimaryKeyOnly, "primary-key-only", false, "Primary key columns only.")
 	flag.IntVar(&Config.Progress, "progress", 0, "Print progress information every X rows.")
 	flag.BoolVar(&Config.Purge, "purge", false, "Purge instead of archiving.")
 	flag.BoolVar(&Config.Quiet, "quiet", false, "Do not print any output, such as for --statistics.")
 	flag.BoolVar(&Config.Replace, "Replace", false, "Causes INSERTs into --dest to be written as REPLACE.")
+	flag.BoolVar(&Config.Resume, "resume", false, "Resume after the boundary saved by --checkpoint-file or --checkpoint-table.")
 	flag.IntVar(&Config.Retries, "retry", 1, "Number of retries per timeout or deadlock.")
 	flag.DurationVar(&Config.RunTime, "run-time", defaultZeroTime, "Time to run before exiting in golang time.Duration format.")
 	flag.BoolVar(&Config.NoSafeAutoInc, "no-safe-auto-increment", false, "Disable the auto-increment safety checks.")
-	flag.StringVar(&Config.StopSentinel, "stop-sentinel", "", "Stop if the file exists.")
-	flag.StringVar(&Config.PauseSentinel, "pause-sentinel", "", "Pause if the file exists.")
+	flag.StringVar(&Config.StopSentinel, "stop-sentinel", "/tmp/pt-archiver-sentinel", "Stop if the file exists, checked between chunks.")
+	flag.StringVar(&Config.PauseSentinel, "pause-sentinel", "", "Pause while the file exists, checked between chunks every --check-interval.")
 	flag.StringVar(&Config.SlaveUser, "slave-user", "", "Sets the user to be used to connect to the slaves.")
 	flag.StringVar(&Config.SlavePassword, "slave-password", "", "Sets the password to be used to connect to the slaves.")
-	flag.BoolVar(&Config.ShareLock, "share-lock", false, "Adds the LOCK IN SHARE MODE modifier to SELECT statements.")
+	flag.BoolVar(&Config.ShareLock, "share-lock", false, "Adds the LOCK IN SHARE MODE modifier, or FOR SHARE on MySQL 8.0, to SELECT statements.")
+	flag.BoolVar(&Config.SkipLocked, "skip-locked", false, `Adds SKIP LOCKED to --for-update or --share-lock so the rows locked by another session, a
+   concurrent purge for instance, are skipped. Requires MySQL 8.0.1.`)
 	flag.BoolVar(&Config.SkipFKChecks, "skip-foreign-key-checks", false, "Disables foreign key checks with SET FOREIGN_KEY_CHECKS=0.")
 	flag.DurationVar(&Config.SleepTime, "sleep", defaultZeroTime, "Time to sleep between fetches in golang time.Duration format.")
 	flag.Float64Var(&Config.SleepCoef, "sleep-coef", 0.0, "Calculate --sleep as a multiple of the last SELECT time")
 	flag.StringVar(&Config.Source, "source", "", "DSN specifying the table to archive from.")
 	flag.BoolVar(&Config.Statistics, "statistics", false, "Collect and print timing statistics.")
-	flag.BoolVar(&Config.Stop, "stop", false, "Stop running instances by creating the exit sentinel file.")
+	flag.BoolVar(&Config.Stop, "stop", false, "Stop running instances by creating the stop sentinel file.")
 	flag.BoolVar(&Config.Pause, "pause", false, "Pause running instances by creating the pause sentinel file.")
 	flag.BoolVar(&Config.UnPause, "unpause", false, "Unpause running instances by removing the pause sentinel file.")
 	flag.IntVar(&Config.TxnSize, "txn-size", 1, "Number of rows per transaction (default = 1).")
+	flag.BoolVar(&Config.VerifyDest, "verify-dest", false, `Check the archived rows are in --dest, within its transaction, before deleting them from --source.
+   Each row is looked up with the key used by the DELETE statement and its archived columns compared, NULL-aware.`)
 	flag.BoolVar(&Config.Version, "version", false, "Show version and exit.")
 	flag.StringVar(&Config.Where, "where", "", "WHERE clause to limit which rows to archive (required).")
 	flag.BoolVar(&Config.WhyQuit, "why-quit", false, "Print reason for exiting unless rows exhausted.")
+	flag.IntVar(&Config.Workers, "workers", 1, `Number of workers archiving in parallel disjoint ranges of the first column of the index,
+   which must be an integer. Each worker has its own connections.`)
 }
 
 func (config *Configuration) Print() {
 	fmt.Printf("Parameters read from the command line or at their default values:\n")
 	fmt.Printf("analyze is set to: '%v'\n", config.Analyze)
+	fmt.Printf("archive-children is set to: %v\n", config.ArchiveChildren)
 	fmt.Printf("ascent-first is set to: %v\n", config.AscendFirst)
 	fmt.Printf("ask-pass is set to: %v\n", config.AskPass)
 	fmt.Printf("buffer is set to: %v\n", config.Buffer)
@@ -181,6 +225,11 @@ func (config *Configuration) Print() {
 	fmt.Printf("channel is set to: %v\n", config.Channel)
 	fmt.Printf("check-columns is set to: %v\n", config.CheckColumns)
 	fmt.Printf("check-slave-lag is set to: '%v'\n", config.CheckSlaveLag)
+	fmt.Printf("checkpoint-file is set to: '%v'\n", config.CheckpointFile)
+	fmt.Printf("checkpoint-table is set to: '%v'\n", config.CheckpointTable)
+	fmt.Printf("chunk-time is set to: %v\n", config.ChunkTime)
+	fmt.Printf("chunk-size-min is set to: %v\n", config.ChunkSizeMin)
+	fmt.Printf("chunk-size-max is set to: %v\n", config.ChunkSizeMax)
 	fmt.Printf("check-time is set to: %v\n", config.CheckTime)
 	fmt.Printf("columns is set to: '%v'\n", config.Columns)
 	fmt.Printf("commit-each is set to: %v\n", config.CommitEach)
@@ -188,9 +237,13 @@ func (config *Configuration) Print() {
 	fmt.Printf("dry-run is set to: %v\n", config.DryRun)
 	fmt.Printf("stop-sentinel is set to: '%v'\n", config.StopSentinel)
 	fmt.Printf("file is set to: '%v'\n", config.File)
+	fmt.Printf("file-max-size is set to: %v\n", config.FileMaxSize)
+	fmt.Printf("file-rotate is set to: %v\n", config.FileRotate)
+	fmt.Printf("force-optimize is set to: %v\n", config.ForceOptimize)
 	fmt.Printf("for-update is set to: %v\n", config.ForUpdate)
 	fmt.Printf("header is set to: %v\n", config.Header)
 	fmt.Printf("ignore is set to: %v\n", config.Ignore)
+	fmt.Printf("insert-select is set to: %v\n", config.InsertSelect)
 	fmt.Printf("limit is set to: %v\n", config.Limit)
 	fmt.Printf("local is set to: %v\n", config.Local)
 	fmt.Printf("max-flow-ctl is set to: %v\n", config.MaxFlowCtl)
@@ -208,11 +261,14 @@ func (config *Configuration) Print() {
 	fmt.Printf("purge is set to: %v\n", config.Purge)
 	fmt.Printf("quiet is set to: %v\n", config.Quiet)
 	fmt.Printf("replace is set to: %v\n", config.Replace)
+	fmt.Printf("resume is set to: %v\n", config.Resume)
 	fmt.Printf("retries is set to: %v\n", config.Retries)
 	fmt.Printf("run-time is set to: %v\n", config.RunTime)
 	fmt.Printf("slave-password is set to: '%v'\n", config.SlavePassword)
 	fmt.Printf("slave-user is set to: '%v'\n", config.SlaveUser)
 	fmt.Printf("share-lock is set to: %v\n", config.ShareLock)
+	fmt.Printf("skip-locked is set to: %v\n", config.SkipLocked)
+	fmt.Printf("nowait is set to: %v\n", config.NoWait)
 	fmt.Printf("skip-foreign-key-checks is set to: %v\n", config.SkipFKChecks)
 	fmt.Printf("sleep is set to: %v\n", config.SleepTime)
 	fmt.Printf("sleep-coef is set to: %v\n", config.SleepCoef)
@@ -222,9 +278,11 @@ func (config *Configuration) Print() {
 	fmt.Printf("pause is set to: %v\n", config.Pause)
 	fmt.Printf("unpause is set to: %v\n", config.UnPause)
 	fmt.Printf("txn-size is set to: %v\n", config.TxnSize)
+	fmt.Printf("verify-dest is set to: %v\n", config.VerifyDest)
 	fmt.Printf("version is set to: %v\n", config.Version)
 	fmt.Printf("where is set to: '%v'\n", config.Where)
 	fmt.Printf("why-quit is set to: %v\n", config.WhyQuit)
+	fmt.Printf("workers is set to: %v\n", config.Workers)
 
 }
 
@@ -250,17 +308,35 @@ func (config *Configuration) Validate() error {
 		}
 	}
 
+	// stop, pause and unpause are mutually exclusive. They only handle the
+	// sentinel files so nothing else is required.
+	if (config.Stop && config.Pause) || (config.Stop && config.UnPause) || (config.UnPause && config.Pause) {
+		return fmt.Errorf("The options 'Stop', 'Pause' and 'UnPause' are mutually exclusive")
+	}
+	if config.Stop {
+		if len(config.StopSentinel) == 0 {
+			return fmt.Errorf("'stop' requires 'stop-sentinel'")
+		}
+		return nil
+	}
+	if config.Pause || config.UnPause {
+		if len(config.PauseSentinel) == 0 {
+			return fmt.Errorf("'pause' and 'unpause' require 'pause-sentinel'")
+		}
+		return nil
+	}
+
 	// DSNs must have valid fields: source, dest, check-slaves
 	if len(config.Source) > 0 {
 		if dsn.Validate(config.Source) != nil {
 			return fmt.Errorf("Source is not a valid DSN: '%v'", config.Source)
 		}
 		d := dsn.Dsn{}
-		d.Parse{config.Source}
-		if !len(d.Table) > 0 {
+		d.Parse(config.Source)
+		if len(d.Table) == 0 {
 			return fmt.Errorf("Source DSN requires a 't' (table) element: '%v'", config.Source)
 		}
-		if !len(d.Database) > 0 {
+		if len(d.Database) == 0 {
 			return fmt.Errorf("Source DSN requires a 'D' (table) element: '%v'", config.Source)
 		}
 	} else {
@@ -278,24 +354,21 @@ func (config *Configuration) Validate() error {
 	}
 
 	if len(config.CheckSlaveLag) > 0 {
-		if dsn.Validate(config.CheckSlaveLag) != nil {
-			return fmt.Errorf("CheckSlaveLag is not a valid DSN: '%v'", config.CheckSlaveLag)
+		for _, replica := range strings.Split(config.CheckSlaveLag, ";") {
+			if dsn.Validate(replica) != nil {
+				return fmt.Errorf("CheckSlaveLag is not a valid DSN: '%v'", replica)
+			}
 		}
 	}
 
-	// exit, pause and unpause are mutually exclusive
-	if (config.Stop && config.Pause) || (config.Stop && config.UnPause) || (config.UnPause && config.Pause) {
-		return fmt.Errorf("The options 'Stop', 'Pause' and 'UnPause' are mutually exclusive")
-	}
-
 	// where must be set
 	if len(config.Where) == 0 {
 		return fmt.Errorf("'where' must be set")
 	}
 
 	// integers all need to be positive (no negative values makes sense)
-	if config.CheckTime < 0 {
-		return fmt.Errorf("'check-time' must be zero or positive")
+	if config.CheckTime < 1 {
+		return fmt.Errorf("'check-interval' must be at least 1")
 	}
 	if config.Limit < 0 {
 		return fmt.Errorf("'limit' must be zero or positive")
@@ -303,6 +376,18 @@ func (config *Configuration) Validate() error {
 	if config.MaxFlowCtl < 0 {
 		return fmt.Errorf("'max-flow-ctl' must be zero positive")
 	}
+	if config.ChunkTime < 0 {
+		return fmt.Errorf("'chunk-time' must be zero or positive")
+	}
+	if config.ChunkSizeMin < 1 {
+		return fmt.Errorf("'chunk-size-min' must be at least 1")
+	}
+	if config.ChunkSizeMax < 0 {
+		return fmt.Errorf("'chunk-size-max' must be zero or positive")
+	}
+	if config.ChunkSizeMax > 0 && config.ChunkSizeMax < config.ChunkSizeMin {
+		return fmt.Errorf("'chunk-size-max' must be greater than 'chunk-size-min'")
+	}
 	if config.Progress < 0 {
 		return fmt.Errorf("'progress' must be zero positive")
 	}
@@ -313,20 +398,111 @@ func (config *Configuration) Validate() error {
 		return fmt.Errorf("'txn-size' must be zero positive")
 	}
 
+	if config.VerifyDest && len(config.Dest) == 0 {
+		return fmt.Errorf("'verify-dest' is meaningless without a destination")
+	}
+
 	if config.BulkInsert && len(config.Dest) == 0 {
 		return fmt.Errorf("'bulk-insert' is meaningless without a destination")
 	}
 
-	if config.BulkDelete && config.BulkDeleteLimit < 2 {
-		return fmt.Errorf("'bulk-delete' is meaningless with 'bulk-delete-limit 1'")
+	// The rows are not read by the tool
+	if config.InsertSelect {
+		if len(config.Dest) == 0 {
+			return fmt.Errorf("'insert-select' is meaningless without a destination")
+		}
+		if config.BulkInsert || config.VerifyDest || len(config.File) > 0 || len(config.Plugin) > 0 {
+			return fmt.Errorf("'insert-select' is not supported with 'bulk-insert', 'verify-dest', 'file' and 'plugin'")
+		}
+	}
+
+	if config.BulkDelete && config.Limit < 2 {
+		return fmt.Errorf("'bulk-delete' is meaningless with 'limit 1'")
 	}
 
 	if config.Purge && config.NoDelete {
 		return fmt.Errorf("'purge' and 'no-delete' are mutualy exclusive")
 	}
 
-	if config.BulkDelete && config.BulkInsert {
-		config.CommitEach = false
+	if !config.Purge && len(config.Dest) == 0 && len(config.File) == 0 {
+		return fmt.Errorf("One of 'dest', 'file' or 'purge' must be set")
+	}
+
+	if config.ArchiveChildren {
+		if config.NoDelete {
+			return fmt.Errorf("'archive-children' is meaningless with 'no-delete'")
+		}
+		// The child rows are not written to the file
+		if !config.Purge && len(config.Dest) == 0 {
+			return fmt.Errorf("'archive-children' requires 'dest' or 'purge'")
+		}
+	}
+
+	if config.FileMaxSize < 0 {
+		return fmt.Errorf("'file-max-size' must be zero or positive")
+	}
+	if (config.FileMaxSize > 0 || config.FileRotate) && len(config.File) == 0 {
+		return fmt.Errorf("'file-max-size' and 'file-rotate' are meaningless without 'file'")
+	}
+
+	if config.ForUpdate && config.ShareLock {
+		return fmt.Errorf("'for-update' and 'share-lock' are mutualy exclusive")
+	}
+	if config.SkipLocked && config.NoWait {
+		return fmt.Errorf("'skip-locked' and 'nowait' are mutualy exclusive")
+	}
+	if (config.SkipLocked || config.NoWait) && !config.ForUpdate && !config.ShareLock {
+		return fmt.Errorf("'skip-locked' and 'nowait' require 'for-update' or 'share-lock'")
+	}
+	// The rows skipped by the SELECT are between the boundaries of the chunk
+	if config.SkipLocked && (config.BulkDelete || config.BulkInsert || config.InsertSelect) {
+		return fmt.Errorf("'skip-locked' is not supported with 'bulk-delete', 'bulk-insert' and 'insert-select'")
+	}
+	// The boundaries of the chunk only cover the first column of the index
+	if config.AscendFirst && (config.BulkDelete || config.BulkInsert || config.InsertSelect) {
+		return fmt.Errorf("'ascent-first' is not supported with 'bulk-delete', 'bulk-insert' and 'insert-select'")
+	}
+
+	if len(config.Columns) > 0 && config.PrimaryKeyOnly {
+		return fmt.Errorf("'columns' and 'primary-key-only' are mutualy exclusive")
+	}
+
+	if len(config.CheckpointFile) > 0 && len(config.CheckpointTable) > 0 {
+		return fmt.Errorf("'checkpoint-file' and 'checkpoint-table' are mutualy exclusive")
+	}
+
+	if config.Resume {
+		if len(config.CheckpointFile) == 0 && len(config.CheckpointTable) == 0 {
+			return fmt.Errorf("'resume' requires 'checkpoint-file' or 'checkpoint-table'")
+		}
+		if config.NoAscend {
+			return fmt.Errorf("'resume' and 'no-ascend' are mutualy exclusive")
+		}
+	}
+
+	if config.Workers < 1 {
+		return fmt.Errorf("'workers' must be at least 1")
+	}
+	if config.Workers > 1 {
+		if len(config.File) > 0 {
+			return fmt.Errorf("'file' is not supported with multiple 'workers'")
+		}
+		if len(config.CheckpointFile) > 0 || len(config.CheckpointTable) > 0 {
+			return fmt.Errorf("'checkpoint-file' and 'checkpoint-table' are not supported with multiple 'workers'")
+		}
+	}
+
+	// Without deletes and without ascending the index, the same rows would be fetched forever
+	if config.NoAscend && config.NoDelete {
+		return fmt.Errorf("'no-ascend' and 'no-delete' are mutualy exclusive")
+	}
+
+	// bulk-insert and insert-select imply bulk-delete which implies commit-each
+	if config.BulkInsert || config.InsertSelect {
+		config.BulkDelete = true
+	}
+	if config.BulkDelete {
+		config.CommitEach = true
 	}
 
 	// All good so nil
@@ -338,23 +514,28 @@ func (config *Configuration) Usage() error {
 	return nil
 }
 
+// GenStats runs f, counting the calls and the time spent in nanoseconds
+// under the name when --statistics is set.
 func GenStats(config *Configuration, name string, f func()) {
 	if config.Statistics {
-		start := time.Now().UnixMilli()
-		cnt, ok := stats[name+"_count"]
-		if ok {
-			// Do something
-			stats[name+"_count"] = cnt + 1
-		} else {
-			stats[name+"_count"] = 1
-		}
+		start := time.Now()
 		f()
-		stats[name+"_time"] = (time.Now().UnixMilli() - start)
+		statsLock.Lock()
+		Statistics[name+"_count"]++
+		Statistics[name+"_time"] += time.Since(start).Nanoseconds()
+		statsLock.Unlock()
 	} else {
 		f()
 	}
 }
 
+// AddStat adds n to the named statistic
+func AddStat(name string, n int64) {
+	statsLock.Lock()
+	Statistics[name] += n
+	statsLock.Unlock()
+}
+
 func main() {
 
 	// is PTDEBUG environment variable set to 1?
@@ -370,7 +551,7 @@ func main() {
 	}
 	// Override Usage to get more details
 	flag.Usage = func() {
-		fmt.Print(
+		fmt.Printf("%s",
 			`
 Usage: pt-archiver [OPTIONS] --source DSN --where WHERE
 
@@ -418,91 +599,37 @@ Purge (delete) orphan rows from child table:
 	// Initialize the Statistics Map
 	Statistics = make(map[string]int64)
 
-	// First things first: if --stop was given, create the exit sentinel file.
-	if Config.Stop && len(Config.ExitSentinel) > 0 {
-		_, err := os.Stat(Config.ExitSentinel)
-		if os.IsNotExist(err) {
-			file, err := os.Create(Config.ExitSentinel)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer file.Close()
-			fmt.Printf("Successfully created exit sentinel file: '%v'\n", Config.ExitSentinel)
-		} else {
-			fmt.Printf("Exit sentinel file already exists: '%v'\n", Config.ExitSentinel)
-			os.Exit(1)
-		}
-	}
-
-	// if --pause was given, create the pause sentinel file.
-	if Config.Pause && len(Config.PauseSentinel) > 0 {
-		_, err := os.Stat(Config.PauseSentinel)
-		if os.IsNotExist(err) {
-			file, err := os.Create(Config.PauseSentinel)
-			if err != nil {
-				log.Fatal(err)
+	// --stop, --pause and --unpause only create or remove the sentinel files
+	// polled by the running instances.
+	if Config.Stop || Config.Pause || Config.UnPause {
+		var err error
+		switch {
+		case Config.Stop:
+			err = sentinel.Create(Config.StopSentinel)
+			if err == nil {
+				fmt.Printf("Successfully created the stop sentinel file: '%v'\n", Config.StopSentinel)
 			}
-			defer file.Close()
-			fmt.Printf("Successfully created the pause sentinel file: '%v'\n", Config.PauseSentinel)
-		} else {
-			fmt.Printf("Pause sentinel file already exists: '%v'\n", Config.PauseSentinel)
-			os.Exit(1)
-		}
-	}
-
-	// if --unpause was given, remove the pause sentinel file.
-	if Config.UnPause && len(Config.PauseSentinel) > 0 {
-		_, err := os.Stat(Config.PauseSentinel)
-		if !os.IsNotExist(err) {
-			err := os.Remove(Config.PauseSentinel)
-			if err != nil {
-				log.Fatal(err)
+		case Config.Pause:
+			err = sentinel.Create(Config.PauseSentinel)
+			if err == nil {
+				fmt.Printf("Successfully created the pause sentinel file: '%v'\n", Config.PauseSentinel)
 			}
-			defer file.Close()
-			fmt.Printf("Successfully removed the pause sentinel file: '%v'\n", Config.PauseSentinel)
-		} else {
-			fmt.Printf("Pause sentinel file didn't already exists: '%v'\n", Config.PauseSentinel)
-			os.Exit(1)
-		}
-	}
-
-	// Generate a filename with sprintf-like formatting codes.
-	if len(Config.File) > 0 {
-		t := time.Now()
-		fileComponent := make(map[string]String)
-		fileComponent["d"] = strconv.Itoa(t.Day())        // Day on month
-		fileComponent["H"] = strconv.Itoa(t.Hour())       // Current hour
-		fileComponent["i"] = strconv.Itoa(t.Minute())     // Current minute
-		fileComponent["m"] = strconv.Itoa(int(t.Month())) // Current month
-		fileComponent["s"] = strconv.Itoa(t.Second())     // Current second
-		fileComponent["Y"] = strconv.Itoa(t.Year())       // Current Year
-		fileComponent["D"] = ""
-		fileComponent["t"] = ""
-		if len(Config.Source) > 0 {
-			// Since the configuration is validated, we know for sure
-			// There is a Database and table defined
-			d := Dsn{}
-			d.Parse{Config.Source}
-			fileComponent["D"] = d.Database
-			fileComponent["t"] = d.table
-		}
-		needPaddingTags := [5]string{"d", "H", "i", "m", "s"}
-		for _, tag := range needPaddingTags {
-			// if the len(fileComponent[tag]) is 1, need to prefix by '0'
-			if len(fileComponent[tag]) == 1 {
-				fileComponent[tag] = "0" + fileComponent[tag]
+		default:
+			err = sentinel.Remove(Config.PauseSentinel)
+			if err == nil {
+				fmt.Printf("Successfully removed the pause sentinel file: '%v'\n", Config.PauseSentinel)
 			}
 		}
-		replaceTags := [8]string{"d", "H", "i", "m", "s", "Y", "D", "t"}
-		for _, tag := range replaceTags {
-			re := regexp.MustCompile("%" + tag)
-			re.ReplaceAllString(Config.File, fileComponent[tag])
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
 		}
+		os.Exit(0)
 	}
 
 	// Could add Daemonize/forking option but not really needed (TODO)
 
-	// Check if --pid is set and if it exists
+	// Check if --pid is set and if it exists. The file is removed by exit.
 	if len(Config.Pid) > 0 {
 		_, err := os.Stat(Config.Pid)
 		if os.IsNotExist(err) {
@@ -510,19 +637,46 @@ Purge (delete) orphan rows from child table:
 			if err != nil {
 				log.Fatal(err)
 			}
+			pidFile = Config.Pid
 			p := os.Getpid()
-			n3, err := file.WriteString(fmt.Sprintf("%s\n", p))
-			defer func() {
-				file.Close()
-				os.Remove(Config.Pid)
-			}()
+			_, err = file.WriteString(fmt.Sprintf("%d\n", p))
+			file.Close()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to write the pid file: %v\n", err)
+				exit(exitError)
+			}
 		} else {
 			fmt.Printf("Pid file exists: '%v'\n", Config.Pid)
 			os.Exit(1)
 		}
 	}
 
-	var srcDsn dsn.Dsn
-	var dstDsn dsn.Dsn
+	archiver, err := NewWorkerPool(&Config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error archiving: %v\n", err)
+		exit(exitError)
+	}
+
+	if Config.DryRun {
+		archiver.DryRun(os.Stdout)
+		archiver.Close()
+		exit(exitOk)
+	}
+
+	done := make(chan struct{})
+	trapSignals(archiver, done)
+	err = archiver.Run()
+	archiver.Close()
+	close(done)
+	archiver.Report()
 
+	code := exitOk
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error archiving: %v\n", err)
+		code = exitError
+	}
+	if sig := archiver.Interrupted(); sig != nil {
+		code = signalCode(sig)
+	}
+	exit(code)
 }
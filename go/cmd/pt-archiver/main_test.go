@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+// validConfig returns a configuration passing Validate
+func validConfig() Configuration {
+	return Configuration{Source: "h=db1,D=db,t=t", Purge: true, Where: "1=1",
+		CheckTime: 1, ChunkSizeMin: 1, Workers: 1, Limit: 100}
+}
+
+func TestValidateLocking(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		set   func(*Configuration)
+		valid bool
+	}{
+		{"for-update", func(c *Configuration) { c.ForUpdate = true }, true},
+		{"share-lock", func(c *Configuration) { c.ShareLock = true }, true},
+		{"for-update skip-locked", func(c *Configuration) { c.ForUpdate, c.SkipLocked = true, true }, true},
+		{"share-lock nowait", func(c *Configuration) { c.ShareLock, c.NoWait = true, true }, true},
+		{"for-update share-lock", func(c *Configuration) { c.ForUpdate, c.ShareLock = true, true }, false},
+		{"skip-locked nowait", func(c *Configuration) { c.ForUpdate, c.SkipLocked, c.NoWait = true, true, true }, false},
+		{"skip-locked alone", func(c *Configuration) { c.SkipLocked = true }, false},
+		{"nowait alone", func(c *Configuration) { c.NoWait = true }, false},
+		// The rows skipped would be deleted by the bulk DELETE
+		{"skip-locked bulk-delete", func(c *Configuration) { c.ForUpdate, c.SkipLocked, c.BulkDelete = true, true, true }, false},
+		{"nowait bulk-delete", func(c *Configuration) { c.ForUpdate, c.NoWait, c.BulkDelete = true, true, true }, true},
+		{"skip-locked bulk-insert", func(c *Configuration) {
+			c.ForUpdate, c.SkipLocked, c.BulkInsert, c.Dest = true, true, true, "h=db2,D=arch"
+		}, false},
+		{"skip-locked insert-select", func(c *Configuration) {
+			c.ForUpdate, c.SkipLocked, c.InsertSelect, c.Dest = true, true, true, "h=db2,D=arch"
+		}, false},
+	} {
+		config := validConfig()
+		c.set(&config)
+		if err := config.Validate(); (err == nil) != c.valid {
+			t.Errorf("%v: expected valid: %v, got %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestValidateCheckInterval(t *testing.T) {
+	// The throttlers and the pause sentinel would poll without sleeping
+	for _, interval := range []int{0, -1} {
+		config := validConfig()
+		config.CheckTime = interval
+		if err := config.Validate(); err == nil {
+			t.Errorf("Validate with check-interval %d didn't return an error", interval)
+		}
+	}
+	config := validConfig()
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate with check-interval 1 returned an error: %v", err)
+	}
+}
+
+func TestValidateAscendFirst(t *testing.T) {
+	// The bulk DELETE would remove the rows of the other values of the
+	// next index columns
+	for _, c := range []struct {
+		name  string
+		set   func(*Configuration)
+		valid bool
+	}{
+		{"ascent-first", func(c *Configuration) { c.AscendFirst = true }, true},
+		{"ascent-first bulk-delete", func(c *Configuration) { c.AscendFirst, c.BulkDelete = true, true }, false},
+		{"ascent-first bulk-insert", func(c *Configuration) {
+			c.AscendFirst, c.BulkInsert, c.Dest = true, true, "h=db2,D=arch"
+		}, false},
+		{"ascent-first insert-select", func(c *Configuration) {
+			c.AscendFirst, c.InsertSelect, c.Dest = true, true, "h=db2,D=arch"
+		}, false},
+	} {
+		config := validConfig()
+		c.set(&config)
+		if err := config.Validate(); (err == nil) != c.valid {
+			t.Errorf("%v: expected valid: %v, got %v", c.name, c.valid, err)
+		}
+	}
+}
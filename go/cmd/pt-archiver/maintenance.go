@@ -0,0 +1,131 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   Once the rows are archived, --analyze and --optimize run ANALYZE TABLE
+   and OPTIMIZE TABLE on the source and/or dest tables, not written to the
+   binary log with --local. On InnoDB, OPTIMIZE TABLE recreates the whole
+   table, it is skipped unless --force-optimize is set.
+
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/y-trudeau/go-toolkit/go/pkg/debug"
+	"github.com/y-trudeau/go-toolkit/go/pkg/tableparser"
+)
+
+// Engines where OPTIMIZE TABLE is mapped to a full rebuild of the table
+var rebuildEngines = []string{"innodb"}
+
+// maintStmt is an ANALYZE or OPTIMIZE statement run after archiving
+type maintStmt struct {
+	verb string
+	dest bool // run on dest, on the source otherwise
+	sql  string
+	skip string // why the statement is not run, empty if it is
+}
+
+// maintenanceSql returns the statements of --analyze and --optimize
+func (a *Archiver) maintenanceSql() []maintStmt {
+	binlog := ""
+	if a.config.Local {
+		binlog = " NO_WRITE_TO_BINLOG"
+	}
+	type table struct {
+		flag string
+		dest bool
+		name string
+		info tableparser.TableInfo
+	}
+	tables := []table{{"s", false, a.srcName, a.srcTbl}}
+	if a.hasDest {
+		tables = append(tables, table{"d", true, a.dstName, a.dstTbl})
+	}
+
+	var stmts []maintStmt
+	for _, op := range []struct{ verb, tables string }{
+		{"ANALYZE", a.config.Analyze},
+		{"OPTIMIZE", a.config.Optimize},
+	} {
+		for _, tbl := range tables {
+			if !strings.Contains(op.tables, tbl.flag) {
+				continue
+			}
+			stmt := maintStmt{verb: op.verb, dest: tbl.dest, sql: op.verb + binlog + " TABLE " + tbl.name}
+			engine := tbl.info.GetEngine()
+			if op.verb == "OPTIMIZE" && !a.config.ForceOptimize && slices.Contains(rebuildEngines, strings.ToLower(engine)) {
+				stmt.skip = fmt.Sprintf("it rebuilds the %v table, use --force-optimize to run it", engine)
+			}
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
+}
+
+// maintain runs the statements of --analyze and --optimize, timed in the
+// statistics.
+func (a *Archiver) maintain() error {
+	for _, stmt := range a.maintenanceSql() {
+		if len(stmt.skip) > 0 {
+			if !a.config.Quiet {
+				fmt.Fprintf(os.Stderr, "Skipping %v, %v\n", stmt.sql, stmt.skip)
+			}
+			continue
+		}
+		dbh := a.src.Dbh
+		if stmt.dest {
+			dbh = a.dst.Dbh
+		}
+		var err error
+		GenStats(a.config, stmt.verb, func() {
+			err = runMaintenance(a.ctx, dbh, stmt.sql)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runMaintenance runs an ANALYZE or OPTIMIZE statement, the server reports
+// the errors in the result set.
+func runMaintenance(ctx context.Context, dbh *sql.DB, query string) error {
+	debug.Printvar("Running", query)
+	rows, err := dbh.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("Unable to run %v: %w", query, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, op, msgType, msgText string
+		if err := rows.Scan(&table, &op, &msgType, &msgText); err != nil {
+			return err
+		}
+		debug.Print(fmt.Sprintf("%v %v %v: %v", op, table, msgType, msgText))
+		if strings.EqualFold(msgType, "error") {
+			return fmt.Errorf("Unable to run %v: %v", query, msgText)
+		}
+	}
+	return rows.Err()
+}
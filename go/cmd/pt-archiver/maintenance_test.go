@@ -0,0 +1,52 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// archiveTable is a MyISAM dest, OPTIMIZE doesn't rebuild it
+const archiveTable = "CREATE TABLE `orders` (\n" +
+	"  `id` bigint unsigned NOT NULL,\n" +
+	"  `customer_id` int NOT NULL,\n" +
+	"  `created` datetime NOT NULL,\n" +
+	"  `note` varchar(64) DEFAULT NULL,\n" +
+	"  PRIMARY KEY (`id`)\n" +
+	") ENGINE=MyISAM DEFAULT CHARSET=utf8mb4"
+
+func TestMaintenanceSql(t *testing.T) {
+	skip := "it rebuilds the InnoDB table, use --force-optimize to run it"
+	for _, c := range []struct {
+		name    string
+		config  Configuration
+		hasDest bool
+		e       []maintStmt
+	}{
+		{"none", Configuration{}, true, nil},
+		{"analyze", Configuration{Analyze: "sd"}, true, []maintStmt{
+			{"ANALYZE", false, "ANALYZE TABLE `db`.`orders`", ""},
+			{"ANALYZE", true, "ANALYZE TABLE `arch`.`orders`", ""},
+		}},
+		{"local", Configuration{Analyze: "d", Optimize: "ds", Local: true}, true, []maintStmt{
+			{"ANALYZE", true, "ANALYZE NO_WRITE_TO_BINLOG TABLE `arch`.`orders`", ""},
+			{"OPTIMIZE", false, "OPTIMIZE NO_WRITE_TO_BINLOG TABLE `db`.`orders`", skip},
+			{"OPTIMIZE", true, "OPTIMIZE NO_WRITE_TO_BINLOG TABLE `arch`.`orders`", ""},
+		}},
+		{"force-optimize", Configuration{Optimize: "sd", ForceOptimize: true}, true, []maintStmt{
+			{"OPTIMIZE", false, "OPTIMIZE TABLE `db`.`orders`", ""},
+			{"OPTIMIZE", true, "OPTIMIZE TABLE `arch`.`orders`", ""},
+		}},
+		// d is ignored without dest
+		{"no dest", Configuration{Analyze: "sd", Optimize: "sd"}, false, []maintStmt{
+			{"ANALYZE", false, "ANALYZE TABLE `db`.`orders`", ""},
+			{"OPTIMIZE", false, "OPTIMIZE TABLE `db`.`orders`", skip},
+		}},
+	} {
+		a := &Archiver{config: &c.config, hasDest: c.hasDest,
+			srcName: "`db`.`orders`", srcTbl: parsedTable(t, ordersTable),
+			dstName: "`arch`.`orders`", dstTbl: parsedTable(t, archiveTable)}
+		if stmts := a.maintenanceSql(); !slices.Equal(stmts, c.e) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.e, stmts)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   The run controller keeps track of the rows selected, inserted and
+   deleted, prints the --progress lines, enforces --run-time and prints the
+   --why-quit reason and the --statistics report at the end. It is shared
+   by the --workers.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons for leaving the main loop, printed by --why-quit
+const (
+	quitExhausted = "there are no more rows"
+	quitRunTime   = "--run-time expired"
+	quitError     = "of an error"
+	quitSignal    = "of signal "
+	quitSentinel  = "the stop sentinel file exists"
+	quitWorker    = "another worker failed"
+)
+
+// Timestamp format of the progress and statistics lines, as the Perl tool
+const reportTime = "2006-01-02T15:04:05"
+
+type runControl struct {
+	config   *Configuration
+	out      io.Writer
+	start    time.Time
+	selected atomic.Int64
+	inserted atomic.Int64
+	deleted  atomic.Int64
+	archived atomic.Int64 // rows processed, --progress is based on this count
+	mu       sync.Mutex   // protects end, reason and the progress lines
+	end      time.Time
+	reason   string
+}
+
+// newRunControl returns a run controller printing its output to out
+func newRunControl(config *Configuration, out io.Writer) *runControl {
+	return &runControl{config: config, out: out}
+}
+
+// begin starts the clock and prints the progress header
+func (rc *runControl) begin() {
+	rc.start = time.Now()
+	if rc.config.Progress > 0 && !rc.config.Quiet {
+		fmt.Fprintf(rc.out, "%-19s %7s %7s\n", "TIME", "ELAPSED", "COUNT")
+		rc.printProgress()
+	}
+}
+
+// printProgress prints the number of rows processed so far
+func (rc *runControl) printProgress() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	fmt.Fprintf(rc.out, "%-19s %7d %7d\n", time.Now().Format(reportTime),
+		int64(time.Since(rc.start).Seconds()), rc.archived.Load())
+}
+
+// rowCounts are the rows of a transaction, counted once it is committed
+type rowCounts struct {
+	inserted int64
+	deleted  int64
+	archived int64
+}
+
+// add counts the rows of a committed transaction and prints a progress line
+// each time a multiple of --progress rows is crossed.
+func (rc *runControl) add(c rowCounts) {
+	rc.inserted.Add(c.inserted)
+	rc.deleted.Add(c.deleted)
+	n := rc.archived.Add(c.archived)
+	if rc.config.Progress > 0 && !rc.config.Quiet && n/int64(rc.config.Progress) != (n-c.archived)/int64(rc.config.Progress) {
+		rc.printProgress()
+	}
+}
+
+// expired returns true once --run-time has elapsed. It is checked between
+// chunks so the current chunk is always completed.
+func (rc *runControl) expired() bool {
+	return rc.config.RunTime > 0 && time.Since(rc.start) >= rc.config.RunTime
+}
+
+// quit records the reason for leaving the main loop. The first one wins
+// unless an error happens afterwards, while committing for instance. The
+// rows being exhausted has the lowest priority, a worker done with its range
+// must not hide why the others stopped.
+func (rc *runControl) quit(reason string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.reason) == 0 || rc.reason == quitExhausted || reason == quitError {
+		rc.reason = reason
+	}
+	rc.end = time.Now()
+}
+
+// exitReason returns the reason recorded by quit
+func (rc *runControl) exitReason() string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.reason
+}
+
+// report prints the reason for exiting with --why-quit and the statistics
+// with --statistics. Nothing is printed with --quiet.
+func (rc *runControl) report(source string, dest string, stats map[string]int64) {
+	if rc.config.Quiet {
+		return
+	}
+	if rc.config.Progress > 0 && rc.archived.Load()%int64(rc.config.Progress) != 0 {
+		rc.printProgress()
+	}
+	if rc.config.WhyQuit && rc.reason != quitExhausted {
+		fmt.Fprintf(rc.out, "Exiting because %v\n", rc.reason)
+	}
+	if !rc.config.Statistics {
+		return
+	}
+
+	fmt.Fprintf(rc.out, "Started at %v, ended at %v\n", rc.start.Format(reportTime), rc.end.Format(reportTime))
+	fmt.Fprintf(rc.out, "Source: %v\n", source)
+	if len(dest) > 0 {
+		fmt.Fprintf(rc.out, "Dest: %v\n", dest)
+	}
+	fmt.Fprintf(rc.out, "SELECT %d\n", rc.selected.Load())
+	fmt.Fprintf(rc.out, "INSERT %d\n", rc.inserted.Load())
+	fmt.Fprintf(rc.out, "DELETE %d\n", rc.deleted.Load())
+	if stats["retries"] > 0 {
+		fmt.Fprintf(rc.out, "Retries %d\n", stats["retries"])
+	}
+	fmt.Fprintf(rc.out, "Exit reason: %v\n", rc.reason)
+
+	// Actions are sorted by time spent, what is not timed is reported as other
+	var actions []string
+	for key := range stats {
+		if strings.HasSuffix(key, "_count") {
+			actions = append(actions, strings.TrimSuffix(key, "_count"))
+		}
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		if stats[actions[i]+"_time"] == stats[actions[j]+"_time"] {
+			return actions[i] < actions[j]
+		}
+		return stats[actions[i]+"_time"] > stats[actions[j]+"_time"]
+	})
+
+	total := rc.end.Sub(rc.start).Nanoseconds()
+	other := total
+	fmt.Fprintf(rc.out, "%-15s %10s %10s %10s\n", "Action", "Count", "Time", "Pct")
+	for _, action := range actions {
+		spent := stats[action+"_time"]
+		other -= spent
+		fmt.Fprintf(rc.out, "%-15s %10d %10.4f %10.2f\n", strings.ToLower(action), stats[action+"_count"],
+			float64(spent)/1e9, pct(spent, total))
+	}
+	if other < 0 {
+		other = 0
+	}
+	fmt.Fprintf(rc.out, "%-15s %10d %10.4f %10.2f\n", "other", 0, float64(other)/1e9, pct(other, total))
+}
+
+// pct returns part as a percentage of total
+func pct(part int64, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(total)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestQuit(t *testing.T) {
+	for _, c := range []struct {
+		reasons []string
+		e       string
+	}{
+		{[]string{quitExhausted}, quitExhausted},
+		// A worker done with its range doesn't hide why the others stopped
+		{[]string{quitExhausted, quitSentinel}, quitSentinel},
+		{[]string{quitRunTime, quitExhausted}, quitRunTime},
+		// The first reason wins
+		{[]string{quitSignal + "interrupt", quitWorker, quitRunTime}, quitSignal + "interrupt"},
+		// Unless an error happens afterwards
+		{[]string{quitRunTime, quitError, quitExhausted}, quitError},
+		{[]string{quitError, quitWorker}, quitError},
+	} {
+		rc := newRunControl(&Configuration{}, io.Discard)
+		for _, r := range c.reasons {
+			rc.quit(r)
+		}
+		if rc.exitReason() != c.e {
+			t.Errorf("quit %q: expected '%v', got '%v'", c.reasons, c.e, rc.exitReason())
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	{
+		// --why-quit only prints the reason when the rows are not exhausted
+		var buf bytes.Buffer
+		rc := newRunControl(&Configuration{WhyQuit: true}, &buf)
+		rc.quit(quitExhausted)
+		rc.report("`db`.`t`", "", nil)
+		if buf.Len() != 0 {
+			t.Errorf("why-quit with rows exhausted: expected no output, got %q", buf.String())
+		}
+		rc.quit(quitSentinel)
+		rc.report("`db`.`t`", "", nil)
+		if buf.String() != "Exiting because the stop sentinel file exists\n" {
+			t.Errorf("why-quit: unexpected output %q", buf.String())
+		}
+	}
+	{
+		// --quiet prints nothing
+		var buf bytes.Buffer
+		rc := newRunControl(&Configuration{WhyQuit: true, Statistics: true, Quiet: true}, &buf)
+		rc.quit(quitError)
+		rc.report("`db`.`t`", "`arch`.`t`", nil)
+		if buf.Len() != 0 {
+			t.Errorf("quiet: expected no output, got %q", buf.String())
+		}
+	}
+	{
+		// --statistics, actions sorted by time spent and the rest as other
+		var buf bytes.Buffer
+		rc := newRunControl(&Configuration{Statistics: true}, &buf)
+		rc.start = time.Date(2024, 3, 7, 5, 4, 0, 0, time.UTC)
+		rc.add(rowCounts{inserted: 3, deleted: 3, archived: 3})
+		rc.selected.Add(4)
+		rc.quit(quitRunTime)
+		rc.end = rc.start.Add(10 * time.Second)
+		rc.report("`db`.`t`", "`arch`.`t`", map[string]int64{
+			"SELECT_count": 2, "SELECT_time": 1e9,
+			"INSERT_count": 3, "INSERT_time": 4e9,
+			"retries": 1,
+		})
+		e := "Started at 2024-03-07T05:04:00, ended at 2024-03-07T05:04:10\n" +
+			"Source: `db`.`t`\n" +
+			"Dest: `arch`.`t`\n" +
+			"SELECT 4\n" +
+			"INSERT 3\n" +
+			"DELETE 3\n" +
+			"Retries 1\n" +
+			"Exit reason: --run-time expired\n" +
+			"Action               Count       Time        Pct\n" +
+			"insert                   3     4.0000      40.00\n" +
+			"select                   2     1.0000      10.00\n" +
+			"other                    0     5.0000      50.00\n"
+		if buf.String() != e {
+			t.Errorf("statistics: expected\n%v\ngot\n%v", e, buf.String())
+		}
+	}
+	{
+		// The last progress line is printed unless it was just printed
+		var buf bytes.Buffer
+		rc := newRunControl(&Configuration{Progress: 2}, &buf)
+		rc.begin()
+		rc.add(rowCounts{archived: 3})
+		rc.quit(quitExhausted)
+		rc.report("`db`.`t`", "", nil)
+		re := regexp.MustCompile(`(?m)^\S+ +\d+ +(\d+)$`)
+		var counts []string
+		for _, m := range re.FindAllStringSubmatch(buf.String(), -1) {
+			counts = append(counts, m[1])
+		}
+		if len(counts) != 3 || counts[0] != "0" || counts[1] != "3" || counts[2] != "3" {
+			t.Errorf("progress: expected the counts 0, 3 and 3, got %q", buf.String())
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   On SIGINT or SIGTERM, the archiver completes the current chunk, commits
+   and exits. A second signal cancels the running statement, rolls back the
+   transactions and exits. In both cases the exit code is 128 + the signal
+   number, like a shell reports a process killed by a signal.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Exit codes
+const (
+	exitOk     = 0
+	exitError  = 1
+	exitSignal = 128 // the signal number is added
+)
+
+// Time given to the main loop to roll back after a second signal, the
+// server rolls back anyway when the connection is dropped.
+const abortDelay = 5 * time.Second
+
+// pidFile is the PID file created by this process, removed by exit
+var pidFile string
+
+// exit removes the PID file and exits with code
+func exit(code int) {
+	if len(pidFile) > 0 {
+		os.Remove(pidFile)
+	}
+	os.Exit(code)
+}
+
+// signalCode returns the exit code matching a signal
+func signalCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return exitSignal + int(s)
+	}
+	return exitSignal
+}
+
+// interruptible is what the signals control
+type interruptible interface {
+	Interrupt(sig os.Signal)
+	Abort()
+}
+
+// trapSignals interrupts the archiver on the first SIGINT or SIGTERM and
+// aborts it on the second one. done must be closed once the archiver is
+// closed.
+func trapSignals(a interruptible, done <-chan struct{}) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		var sig os.Signal
+		select {
+		case sig = <-sigs:
+		case <-done:
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Received %v, exiting after the current chunk\n", sig)
+		a.Interrupt(sig)
+
+		select {
+		case sig = <-sigs:
+		case <-done:
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Received %v again, rolling back and exiting\n", sig)
+		a.Abort()
+		select {
+		case <-done:
+		case <-time.After(abortDelay):
+			exit(signalCode(sig))
+		}
+	}()
+}
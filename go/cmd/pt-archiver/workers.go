@@ -0,0 +1,301 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   With --workers, the range of the first column of the index is split in
+   contiguous sub-ranges, each one archived by its own worker with its own
+   connections. The first worker has no lower boundary and the last one no
+   upper boundary so no row is missed, NULL values included. The workers
+   share the throttlers, the statistics and the run controller, and they all
+   poll the same sentinel files.
+
+*/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/y-trudeau/go-toolkit/go/pkg/debug"
+	"github.com/y-trudeau/go-toolkit/go/pkg/quoter"
+	"github.com/y-trudeau/go-toolkit/go/pkg/tablenibbler"
+
+	"go-toolkit/pkg/throttler"
+)
+
+// Only the integer columns can be split in ranges
+var reIntType = regexp.MustCompile(`^(tiny|small|medium|big)?int`)
+
+// sharedThrottle serializes the checks of the throttlers shared by the
+// workers, a single worker checks while the others wait for it.
+type sharedThrottle struct {
+	turn       chan struct{} // holds a value while a worker checks
+	throttlers []throttler.Throttler
+}
+
+// Wait calls Wait on all the throttlers. It returns without error as soon as
+// done is closed, while waiting for its turn too.
+func (st *sharedThrottle) Wait(done <-chan struct{}) error {
+	select {
+	case st.turn <- struct{}{}:
+	case <-done:
+		return nil
+	}
+	defer func() { <-st.turn }()
+	return throttler.WaitAll(st.throttlers, done)
+}
+
+// newThrottle creates the throttlers checked between chunks
+func newThrottle(config *Configuration) (*sharedThrottle, error) {
+	st := &sharedThrottle{turn: make(chan struct{}, 1)}
+	if len(config.CheckSlaveLag) > 0 {
+		waiter := &throttler.ReplicaLagWaiter{
+			MaxLag:   time.Duration(config.MaxLag) * time.Second,
+			Interval: time.Duration(config.CheckTime) * time.Second,
+		}
+		for _, replica := range strings.Split(config.CheckSlaveLag, ";") {
+			r, err := throttler.NewReplicaLag(replica, config.Channel, config.SlaveUser, config.SlavePassword)
+			if err != nil {
+				return nil, err
+			}
+			waiter.Sources = append(waiter.Sources, r)
+		}
+		st.throttlers = append(st.throttlers, waiter)
+	}
+	if config.MaxFlowCtl > 0 {
+		node, err := throttler.NewGaleraFlowControl(config.Source)
+		if err != nil {
+			return nil, err
+		}
+		st.throttlers = append(st.throttlers, &throttler.FlowControlWaiter{
+			Source:   node,
+			MaxPct:   float64(config.MaxFlowCtl),
+			Interval: time.Duration(config.CheckTime) * time.Second,
+		})
+	}
+	return st, nil
+}
+
+// splitInts returns up to n-1 distinct values splitting [min, max] in n
+// ranges of about the same width.
+func splitInts(min string, max string, n int) ([]string, error) {
+	lo, ok := new(big.Int).SetString(min, 10)
+	if !ok {
+		return nil, fmt.Errorf("Invalid integer '%v'", min)
+	}
+	hi, ok := new(big.Int).SetString(max, 10)
+	if !ok {
+		return nil, fmt.Errorf("Invalid integer '%v'", max)
+	}
+	width := new(big.Int).Sub(hi, lo)
+	var points []string
+	for i := 1; i < n; i++ {
+		p := new(big.Int).Mul(width, big.NewInt(int64(i)))
+		p.Div(p, big.NewInt(int64(n)))
+		p.Add(p, lo)
+		point := p.String()
+		if p.Cmp(lo) > 0 && (len(points) == 0 || points[len(points)-1] != point) {
+			points = append(points, point)
+		}
+	}
+	return points, nil
+}
+
+// splitPoints returns the values of the first column of the index
+// splitting the table in n ranges. There may be less than n-1 values for
+// small tables.
+func (a *Archiver) splitPoints(n int) ([]string, error) {
+	col := a.srcTbl.KeyCols(a.index)[0]
+	if !reIntType.MatchString(a.srcTbl.ColType(col)) {
+		return nil, fmt.Errorf("'workers' requires an index starting with an integer column, `%v` is %v",
+			col, a.srcTbl.ColType(col))
+	}
+	quoted := quoter.Backtick([]string{col})
+	var min, max sql.NullString
+	err := a.src.Dbh.QueryRow("SELECT MIN("+quoted+"), MAX("+quoted+") FROM "+a.srcName).Scan(&min, &max)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get the range of %v: %w", quoted, err)
+	}
+	if !min.Valid {
+		return nil, nil
+	}
+	return splitInts(min.String, max.String, n)
+}
+
+// workerRanges returns the lower and upper boundaries of the len(points)+1
+// workers, the first one has no lower boundary and the last one no upper
+// boundary.
+func workerRanges(points []string) [][2]*string {
+	ranges := make([][2]*string, len(points)+1)
+	for i := range points {
+		ranges[i][1] = &points[i]
+		ranges[i+1][0] = &points[i]
+	}
+	return ranges
+}
+
+// setRange restricts the archiver to the rows of the first column of the
+// index >= lower and < upper, nil meaning unbounded.
+func (a *Archiver) setRange(lower *string, upper *string) error {
+	var err error
+	a.rangeAsc, err = tablenibbler.GenerateAscStmt(a.srcTbl, a.index, a.selCols, true, 0, true)
+	if err != nil {
+		return err
+	}
+	// The placeholders of the boundaries are all bound to the first column
+	bind := func(val string) []any {
+		row := make([]sql.NullString, len(a.selCols))
+		for _, ord := range a.rangeAsc.Slice {
+			row[ord] = sql.NullString{String: val, Valid: true}
+		}
+		return bindArgs(row, a.rangeAsc.Slice)
+	}
+	if lower != nil {
+		a.lower = bind(*lower)
+	}
+	if upper != nil {
+		a.upper = bind(*upper)
+	}
+	return nil
+}
+
+// WorkerPool runs the archivers, one per --workers
+type WorkerPool struct {
+	config   *Configuration
+	run      *runControl
+	throttle *sharedThrottle
+	workers  []*Archiver
+}
+
+// NewWorkerPool creates the archivers and assigns their ranges
+func NewWorkerPool(config *Configuration) (*WorkerPool, error) {
+	p := &WorkerPool{config: config, run: newRunControl(config, os.Stdout)}
+	var err error
+	p.throttle, err = newThrottle(config)
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := NewArchiver(config, 0, p.run)
+	if err != nil {
+		return nil, err
+	}
+	first.throttle = p.throttle
+	p.workers = append(p.workers, first)
+	if config.Workers <= 1 {
+		return p, nil
+	}
+
+	points, err := first.splitPoints(config.Workers)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	debug.PrintArray("Splitting the index range at", points, ", ")
+	for i := 1; i <= len(points); i++ {
+		w, err := NewArchiver(config, i, p.run)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		w.throttle = p.throttle
+		p.workers = append(p.workers, w)
+	}
+	for i, r := range workerRanges(points) {
+		if err := p.workers[i].setRange(r[0], r[1]); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Run runs the workers until they are all done, then --analyze and
+// --optimize. When a worker fails, the others are stopped after their
+// current chunk and the first error is returned.
+func (p *WorkerPool) Run() error {
+	p.run.begin()
+	errs := make([]error, len(p.workers))
+	var wg sync.WaitGroup
+	for i, w := range p.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = w.Run()
+			if errs[i] != nil {
+				for _, other := range p.workers {
+					other.halt(nil)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			if len(p.workers) > 1 {
+				return fmt.Errorf("Worker %d: %w", i, err)
+			}
+			return err
+		}
+	}
+	// Not worth delaying an interrupted run
+	if p.Interrupted() != nil {
+		return nil
+	}
+	return p.workers[0].maintain()
+}
+
+// Interrupt interrupts all the workers
+func (p *WorkerPool) Interrupt(sig os.Signal) {
+	for _, w := range p.workers {
+		w.Interrupt(sig)
+	}
+}
+
+// Interrupted returns the signal received, nil if not interrupted
+func (p *WorkerPool) Interrupted() os.Signal {
+	for _, w := range p.workers {
+		if sig := w.Interrupted(); sig != nil {
+			return sig
+		}
+	}
+	return nil
+}
+
+// Abort aborts all the workers
+func (p *WorkerPool) Abort() {
+	for _, w := range p.workers {
+		w.Abort()
+	}
+}
+
+// Close closes all the workers
+func (p *WorkerPool) Close() {
+	for _, w := range p.workers {
+		w.Close()
+	}
+}
+
+// Report prints the --why-quit reason and the --statistics report
+func (p *WorkerPool) Report() {
+	p.run.report(p.workers[0].srcName, p.workers[0].dstName, Statistics)
+}
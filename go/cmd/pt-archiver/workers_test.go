@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"go-toolkit/pkg/sentinel"
+	"go-toolkit/pkg/throttler"
+)
+
+// lagForever is a throttler waiting until done is closed, like a stopped
+// replica.
+type lagForever struct {
+	waiting chan struct{}
+}
+
+func (l *lagForever) Wait(done <-chan struct{}) error {
+	l.waiting <- struct{}{}
+	<-done
+	return nil
+}
+
+// returns runs f and fails if it doesn't return within a few seconds
+func returns(t *testing.T, name string, f func() error) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() { errc <- f() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("%v returned an error: %v", name, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%v blocked", name)
+	}
+}
+
+func TestSharedThrottle(t *testing.T) {
+	lag := &lagForever{waiting: make(chan struct{})}
+	st := &sharedThrottle{turn: make(chan struct{}, 1), throttlers: []throttler.Throttler{lag}}
+
+	// The first worker waits for the lag, the second one for its turn
+	stop1 := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() { errc <- st.Wait(stop1) }()
+	<-lag.waiting
+	stop2 := make(chan struct{})
+	close(stop2)
+	returns(t, "Wait for the turn", func() error { return st.Wait(stop2) })
+
+	close(stop1)
+	returns(t, "Wait for the lag", func() error { return <-errc })
+
+	// The turn was released
+	go func() { <-lag.waiting }()
+	returns(t, "Wait after the release", func() error { return st.Wait(stop2) })
+}
+
+func TestWaitThrottle(t *testing.T) {
+	stopFile := filepath.Join(t.TempDir(), "stop")
+	newArchiver := func() (*Archiver, *lagForever) {
+		lag := &lagForever{waiting: make(chan struct{})}
+		a := &Archiver{
+			stop:     make(chan struct{}),
+			throttle: &sharedThrottle{turn: make(chan struct{}, 1), throttlers: []throttler.Throttler{lag}},
+			sentinel: &sentinel.Sentinel{StopFile: stopFile, Interval: time.Millisecond},
+		}
+		return a, lag
+	}
+	{
+		// Halted by a signal or another worker
+		a, lag := newArchiver()
+		go func() {
+			<-lag.waiting
+			a.halt(nil)
+		}()
+		returns(t, "waitThrottle halted", a.waitThrottle)
+	}
+	{
+		// The stop sentinel file appears
+		a, lag := newArchiver()
+		go func() {
+			<-lag.waiting
+			os.WriteFile(stopFile, nil, 0644)
+		}()
+		returns(t, "waitThrottle with the stop sentinel", a.waitThrottle)
+	}
+}
+
+func TestSplitInts(t *testing.T) {
+	for _, c := range []struct {
+		min, max string
+		n        int
+		e        []string
+	}{
+		{"1", "100", 4, []string{"25", "50", "75"}},
+		{"5", "5", 4, nil},
+		{"-100", "-1", 3, []string{"-67", "-34"}},
+		{"-10", "10", 2, []string{"0"}},
+		// More workers than values, no duplicate point
+		{"1", "3", 10, []string{"2"}},
+		{"0", "1", 4, nil},
+		// bigint unsigned above the int64 range
+		{"9223372036854775808", "18446744073709551615", 2, []string{"13835058055282163711"}},
+		{"0", "18446744073709551615", 3, []string{"6148914691236517205", "12297829382473034410"}},
+	} {
+		points, err := splitInts(c.min, c.max, c.n)
+		if err != nil {
+			t.Errorf("splitInts(%v, %v, %d) returned an error: %v", c.min, c.max, c.n, err)
+			continue
+		}
+		if !slices.Equal(points, c.e) {
+			t.Errorf("splitInts(%v, %v, %d): expected %v, got %v", c.min, c.max, c.n, c.e, points)
+		}
+		// Strictly increasing within ]min, max[, at most n-1 points
+		prev, _ := new(big.Int).SetString(c.min, 10)
+		max, _ := new(big.Int).SetString(c.max, 10)
+		for _, p := range points {
+			v, _ := new(big.Int).SetString(p, 10)
+			if v.Cmp(prev) <= 0 || v.Cmp(max) >= 0 {
+				t.Errorf("splitInts(%v, %v, %d): %v is not strictly increasing within the range", c.min, c.max, c.n, points)
+			}
+			prev = v
+		}
+		if len(points) > c.n-1 {
+			t.Errorf("splitInts(%v, %v, %d): expected at most %d points, got %v", c.min, c.max, c.n, c.n-1, points)
+		}
+	}
+	if _, err := splitInts("1", "1e3", 2); err == nil {
+		t.Errorf("splitInts of an invalid integer didn't return an error")
+	}
+}
+
+func TestWorkerRanges(t *testing.T) {
+	for _, points := range [][]string{nil, {"50"}, {"25", "50", "75"}} {
+		ranges := workerRanges(points)
+		if len(ranges) != len(points)+1 {
+			t.Fatalf("workerRanges(%v): expected %d ranges, got %d", points, len(points)+1, len(ranges))
+		}
+		// The first and last workers are open-ended, the ranges contiguous
+		if ranges[0][0] != nil || ranges[len(points)][1] != nil {
+			t.Errorf("workerRanges(%v): the first and last ranges must be open-ended", points)
+		}
+		for i, p := range points {
+			if *ranges[i][1] != p || *ranges[i+1][0] != p {
+				t.Errorf("workerRanges(%v): ranges %d and %d must meet at %v", points, i, i+1, p)
+			}
+		}
+	}
+}
+
+func TestSetRange(t *testing.T) {
+	a := &Archiver{srcTbl: parsedTable(t, ordersTable), index: "PRIMARY",
+		selCols: []string{"id", "customer_id", "created", "note"}}
+	ge, lt := "((`id` >= ?))", "((`id` < ?))"
+	bound := []any{sql.NullString{String: "18446744073709551000", Valid: true}}
+	{
+		// First worker
+		upper := "18446744073709551000"
+		if err := a.setRange(nil, &upper); err != nil {
+			t.Fatalf("setRange returned an error: %v", err)
+		}
+		if a.lower != nil || !slices.Equal(a.upper, bound) {
+			t.Errorf("First worker: expected no lower bound and %v, got %v and %v", bound, a.lower, a.upper)
+		}
+		if a.rangeAsc.Boundaries[">="] != ge || a.rangeAsc.Boundaries["<"] != lt {
+			t.Errorf("Expected the boundaries %v and %v, got %v", ge, lt, a.rangeAsc.Boundaries)
+		}
+	}
+	{
+		// Last worker
+		a.lower, a.upper = nil, nil
+		lower := "18446744073709551000"
+		if err := a.setRange(&lower, nil); err != nil {
+			t.Fatalf("setRange returned an error: %v", err)
+		}
+		if !slices.Equal(a.lower, bound) || a.upper != nil {
+			t.Errorf("Last worker: expected %v and no upper bound, got %v and %v", bound, a.lower, a.upper)
+		}
+	}
+}
@@ -5,6 +5,20 @@ go 1.24.3
 require (
 	github.com/dlclark/regexp2 v1.11.5
 	github.com/go-sql-driver/mysql v1.9.2
+	github.com/klauspost/compress v1.18.0
+	github.com/y-trudeau/go-toolkit/go/pkg/debug v0.0.0
+	github.com/y-trudeau/go-toolkit/go/pkg/dsn v0.0.0
+	github.com/y-trudeau/go-toolkit/go/pkg/quoter v0.0.0
+	github.com/y-trudeau/go-toolkit/go/pkg/tablenibbler v0.0.0
+	github.com/y-trudeau/go-toolkit/go/pkg/tableparser v0.0.0
 )
 
 require filippo.io/edwards25519 v1.1.0 // indirect
+
+replace (
+	github.com/y-trudeau/go-toolkit/go/pkg/debug => ./pkg/debug
+	github.com/y-trudeau/go-toolkit/go/pkg/dsn => ./pkg/dsn
+	github.com/y-trudeau/go-toolkit/go/pkg/quoter => ./pkg/quoter
+	github.com/y-trudeau/go-toolkit/go/pkg/tablenibbler => ./pkg/tablenibbler
+	github.com/y-trudeau/go-toolkit/go/pkg/tableparser => ./pkg/tableparser
+)
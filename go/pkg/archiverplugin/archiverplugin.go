@@ -0,0 +1,160 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   This package defines the plugin interface of pt-archiver, the Go
+   equivalent of the Perl tool --plugin modules.
+
+   A plugin is created by a Factory and can be provided in two ways:
+
+   - As a Go plugin, a .so file built with 'go build -buildmode=plugin'
+     exporting a function 'NewPlugin' of type Factory. The path of the .so
+     file is given to --plugin. See https://pkg.go.dev/plugin for the
+     limitations, the plugin must be built with the same Go version and
+     the same version of this package as pt-archiver.
+
+   - Compiled in pt-archiver, for static builds. The plugin package calls
+     Register from an init() function and is imported in pt-archiver with
+     a blank import. Its registered name is given to --plugin.
+
+   A plugin embeds Base so it only has to implement the hooks it needs:
+
+     type purgeLog struct {
+         archiverplugin.Base
+     }
+
+     func (p *purgeLog) IsArchivable(row []sql.NullString) (bool, error) {
+         return row[0].Valid, nil
+     }
+
+     func NewPlugin(t archiverplugin.Table) (archiverplugin.Plugin, error) {
+         return &purgeLog{}, nil
+     }
+
+*/
+
+package archiverplugin
+
+import (
+	"database/sql"
+	"fmt"
+	"plugin"
+	"sync"
+)
+
+// Table describes the table archived, given to the Factory. The archiver
+// connections are busy in transactions, plugins needing to run queries
+// must open their own connections with the DSNs.
+type Table struct {
+	SourceDsn string
+	Database  string
+	Table     string
+	DestDsn   string // empty without --dest
+}
+
+// Plugin is the set of hooks called by pt-archiver. The rows are given
+// with the columns passed to BeforeBegin, in the same order.
+type Plugin interface {
+	// BeforeBegin is called once before the first chunk with the columns
+	// selected and all the columns of the table.
+	BeforeBegin(cols []string, allCols []string) error
+	// IsArchivable returns false for the rows to skip, they are neither
+	// archived nor deleted, except by --bulk-delete which deletes all the
+	// rows between the first and the last rows of the chunk.
+	IsArchivable(row []sql.NullString) (bool, error)
+	// BeforeDelete is called before deleting a row from the source
+	BeforeDelete(row []sql.NullString) error
+	// BeforeBulkDelete is called before deleting a chunk with --bulk-delete
+	BeforeBulkDelete(first []sql.NullString, last []sql.NullString) error
+	// BeforeInsert is called before inserting a row in the dest
+	BeforeInsert(row []sql.NullString) error
+	// BeforeBulkInsert is called before loading a chunk with --bulk-insert
+	BeforeBulkInsert(first []sql.NullString, last []sql.NullString) error
+	// CustomSql returns the statement inserting the row in the dest, it
+	// must have the same placeholders as sqlStr. An empty string means
+	// sqlStr is used.
+	CustomSql(row []sql.NullString, sqlStr string) (string, error)
+	// AfterFinish is called once after the last commit
+	AfterFinish() error
+}
+
+// Factory creates the plugin for the archived table
+type Factory func(t Table) (Plugin, error)
+
+// Base implements all the hooks as no-op, to be embedded by the plugins
+type Base struct{}
+
+func (Base) BeforeBegin(cols []string, allCols []string) error { return nil }
+
+func (Base) IsArchivable(row []sql.NullString) (bool, error) { return true, nil }
+
+func (Base) BeforeDelete(row []sql.NullString) error { return nil }
+
+func (Base) BeforeBulkDelete(first []sql.NullString, last []sql.NullString) error { return nil }
+
+func (Base) BeforeInsert(row []sql.NullString) error { return nil }
+
+func (Base) BeforeBulkInsert(first []sql.NullString, last []sql.NullString) error { return nil }
+
+func (Base) CustomSql(row []sql.NullString, sqlStr string) (string, error) { return "", nil }
+
+func (Base) AfterFinish() error { return nil }
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a compiled in plugin available under name
+func Register(name string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := registry[name]; exists {
+		panic("archiverplugin: plugin '" + name + "' registered twice")
+	}
+	registry[name] = f
+}
+
+// Lookup returns the Factory registered under name
+func Lookup(name string) (Factory, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	f, ok := registry[name]
+	return f, ok
+}
+
+// Load returns the Factory registered under name or, if none, the
+// NewPlugin function of the Go plugin file at path name.
+func Load(name string) (Factory, error) {
+	if f, ok := Lookup(name); ok {
+		return f, nil
+	}
+
+	p, err := plugin.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load the plugin '%v': %v", name, err)
+	}
+	sym, err := p.Lookup("NewPlugin")
+	if err != nil {
+		return nil, fmt.Errorf("Plugin '%v' does not export NewPlugin: %v", name, err)
+	}
+	switch f := sym.(type) {
+	case func(Table) (Plugin, error):
+		return f, nil
+	case *Factory:
+		return *f, nil
+	}
+	return nil, fmt.Errorf("Plugin '%v' NewPlugin is a %T, not a func(archiverplugin.Table) (archiverplugin.Plugin, error)", name, sym)
+}
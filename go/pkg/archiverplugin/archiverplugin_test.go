@@ -0,0 +1,66 @@
+package archiverplugin
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// evenOnly archives only the rows with an even first column
+type evenOnly struct {
+	Base
+	table Table
+}
+
+func (p *evenOnly) IsArchivable(row []sql.NullString) (bool, error) {
+	return row[0].Valid && len(row[0].String) > 0 && (row[0].String[len(row[0].String)-1]-'0')%2 == 0, nil
+}
+
+func newEvenOnly(t Table) (Plugin, error) {
+	return &evenOnly{table: t}, nil
+}
+
+func TestRegister(t *testing.T) {
+	Register("even_only", newEvenOnly)
+
+	f, err := Load("even_only")
+	if err != nil {
+		t.Fatalf("Load of a registered plugin returned an error: %v", err)
+	}
+	p, err := f(Table{Database: "test", Table: "t1"})
+	if err != nil {
+		t.Fatalf("Factory returned an error: %v", err)
+	}
+	if p.(*evenOnly).table.Table != "t1" {
+		t.Errorf("Factory didn't receive the table")
+	}
+
+	ok, _ := p.IsArchivable([]sql.NullString{{String: "12", Valid: true}})
+	if !ok {
+		t.Errorf("IsArchivable: expected 12 to be archivable")
+	}
+	ok, _ = p.IsArchivable([]sql.NullString{{String: "7", Valid: true}})
+	if ok {
+		t.Errorf("IsArchivable: expected 7 not to be archivable")
+	}
+
+	// Hooks not implemented come from Base
+	if q, err := p.CustomSql(nil, "INSERT"); q != "" || err != nil {
+		t.Errorf("Base CustomSql: expected '', got '%v', err: %v", q, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering a plugin twice didn't panic")
+		}
+	}()
+	Register("even_only", newEvenOnly)
+}
+
+func TestLoad(t *testing.T) {
+	if _, ok := Lookup("does_not_exist"); ok {
+		t.Errorf("Lookup found a plugin never registered")
+	}
+	if _, err := Load("/does/not/exist.so"); err == nil {
+		t.Errorf("Load of a missing file didn't return an error")
+	}
+}
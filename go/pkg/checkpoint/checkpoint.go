@@ -0,0 +1,225 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   This package persists the boundary of the last committed nibble, the
+   values bound to the placeholders of the ascending WHERE clause, so a tool
+   can resume its scan of the index after a crash or a restart.
+
+   The checkpoint is stored as JSON, the values encoded in base64 so binary
+   values are kept as is, either in a file, replaced atomically, or in a
+   control table with one row per archived table:
+
+   CREATE TABLE checkpoint (
+     tbl        VARCHAR(255) NOT NULL PRIMARY KEY,
+     boundary   TEXT NOT NULL,
+     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+   )
+
+*/
+
+package checkpoint
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/y-trudeau/go-toolkit/go/pkg/quoter"
+)
+
+// Checkpoint is the boundary of the last committed nibble
+type Checkpoint struct {
+	Table   string   `json:"table"`         // archived table, as db.table
+	Index   string   `json:"index"`         // index ascended
+	Columns []string `json:"columns"`       // column of each placeholder, AscStmt.Scols
+	Values  [][]byte `json:"base64_values"` // value of each placeholder, nil is NULL
+}
+
+// Store saves and loads a checkpoint
+type Store interface {
+	// Load returns false if there is no checkpoint
+	Load() (Checkpoint, bool, error)
+	Save(cp Checkpoint) error
+	// Clear removes the checkpoint once the whole table is processed
+	Clear() error
+}
+
+// New returns the checkpoint of the values bound to the placeholders
+func New(table string, index string, cols []string, vals []sql.NullString) Checkpoint {
+	cp := Checkpoint{Table: table, Index: index, Columns: cols, Values: make([][]byte, len(vals))}
+	for i, v := range vals {
+		if v.Valid {
+			cp.Values[i] = []byte(v.String)
+		}
+	}
+	return cp
+}
+
+// Args returns the values ready to be bound to the placeholders
+func (cp Checkpoint) Args() []any {
+	args := make([]any, len(cp.Values))
+	for i, v := range cp.Values {
+		if v == nil {
+			args[i] = sql.NullString{}
+		} else {
+			args[i] = sql.NullString{String: string(v), Valid: true}
+		}
+	}
+	return args
+}
+
+// Matches returns an error if the checkpoint was not saved for this table,
+// index and placeholders.
+func (cp Checkpoint) Matches(table string, index string, cols []string) error {
+	if cp.Table != table || cp.Index != index || !slices.Equal(cp.Columns, cols) {
+		return fmt.Errorf("The checkpoint of %v on index %v (%v) doesn't match %v on index %v (%v)",
+			cp.Table, cp.Index, cp.Columns, table, index, cols)
+	}
+	if len(cp.Values) != len(cp.Columns) {
+		return fmt.Errorf("The checkpoint has %d values for %d columns", len(cp.Values), len(cp.Columns))
+	}
+	return nil
+}
+
+// FileStore keeps the checkpoint in a file
+type FileStore struct {
+	File string
+}
+
+// Load reads the checkpoint file
+func (fst FileStore) Load() (Checkpoint, bool, error) {
+	var cp Checkpoint
+	data, err := os.ReadFile(fst.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cp, false, nil
+	}
+	if err != nil {
+		return cp, false, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, false, fmt.Errorf("Invalid checkpoint file '%v': %v", fst.File, err)
+	}
+	return cp, true, nil
+}
+
+// Save writes the checkpoint to a temporary file renamed over the previous
+// one, a crash never leaves a partial checkpoint.
+func (fst FileStore) Save(cp Checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fst.File), filepath.Base(fst.File)+".*")
+	if err != nil {
+		return fmt.Errorf("Unable to save the checkpoint: %v", err)
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fst.File)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Unable to save the checkpoint: %v", err)
+	}
+	return nil
+}
+
+// Clear removes the checkpoint file
+func (fst FileStore) Clear() error {
+	err := os.Remove(fst.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// TableStore keeps the checkpoint of a table in a row of a control table
+type TableStore struct {
+	Dbh   *sql.DB
+	Name  string // backticked name of the control table
+	Table string // archived table, the key of the row
+}
+
+// NewTableStore returns a store in the control table db.tbl, the table is
+// created if it doesn't exist.
+func NewTableStore(dbh *sql.DB, db string, tbl string, table string) (*TableStore, error) {
+	ts := &TableStore{Dbh: dbh, Name: quoter.Backtick([]string{db, tbl}), Table: table}
+	_, err := dbh.Exec("CREATE TABLE IF NOT EXISTS " + ts.Name + " (" +
+		"tbl VARCHAR(255) NOT NULL PRIMARY KEY, " +
+		"boundary TEXT NOT NULL, " +
+		"updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP)")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create the checkpoint table %v: %v", ts.Name, err)
+	}
+	return ts, nil
+}
+
+// Load reads the row of the archived table
+func (ts *TableStore) Load() (Checkpoint, bool, error) {
+	var cp Checkpoint
+	var data string
+	err := ts.Dbh.QueryRow("SELECT boundary FROM "+ts.Name+" WHERE tbl = ?", ts.Table).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return cp, false, nil
+	}
+	if err != nil {
+		return cp, false, err
+	}
+	if err := json.Unmarshal([]byte(data), &cp); err != nil {
+		return cp, false, fmt.Errorf("Invalid checkpoint in %v: %v", ts.Name, err)
+	}
+	return cp, true, nil
+}
+
+// Save replaces the row of the archived table
+func (ts *TableStore) Save(cp Checkpoint) error {
+	return ts.save(ts.Dbh.Exec, cp)
+}
+
+// SaveTx replaces the row of the archived table within tx, the checkpoint is
+// committed with the rows it covers.
+func (ts *TableStore) SaveTx(tx *sql.Tx, cp Checkpoint) error {
+	return ts.save(tx.Exec, cp)
+}
+
+func (ts *TableStore) save(exec func(string, ...any) (sql.Result, error), cp Checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	_, err = exec("REPLACE INTO "+ts.Name+" (tbl, boundary) VALUES (?, ?)", ts.Table, string(data))
+	if err != nil {
+		return fmt.Errorf("Unable to save the checkpoint in %v: %v", ts.Name, err)
+	}
+	return nil
+}
+
+// Clear deletes the row of the archived table
+func (ts *TableStore) Clear() error {
+	_, err := ts.Dbh.Exec("DELETE FROM "+ts.Name+" WHERE tbl = ?", ts.Table)
+	return err
+}
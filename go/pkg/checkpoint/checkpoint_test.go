@@ -0,0 +1,114 @@
+package checkpoint
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var boundary = []sql.NullString{
+	{String: "2024-01-01", Valid: true},
+	{String: "2024-01-01", Valid: true},
+	{},
+}
+
+func TestNewArgs(t *testing.T) {
+	cp := New("`db`.`t`", "dt_id", []string{"dt", "dt", "id"}, boundary)
+	if cp.Values[2] != nil || string(cp.Values[0]) != "2024-01-01" {
+		t.Errorf("New: unexpected values %v", cp.Values)
+	}
+	args := cp.Args()
+	for i, v := range boundary {
+		if args[i] != v {
+			t.Errorf("Args: expected %v at %d, got %v", v, i, args[i])
+		}
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	// Invalid UTF-8, a NUL byte, an empty string and NULL
+	vals := []sql.NullString{
+		{String: "\xff\xfe\x00\x80a", Valid: true},
+		{String: "", Valid: true},
+		{},
+	}
+	cp := New("`db`.`t`", "bin", []string{"b", "s", "n"}, vals)
+	fst := FileStore{File: filepath.Join(t.TempDir(), "checkpoint")}
+	if err := fst.Save(cp); err != nil {
+		t.Fatalf("Save returned an error: %v", err)
+	}
+	loaded, found, err := fst.Load()
+	if !found || err != nil {
+		t.Fatalf("Load: expected a checkpoint, got found: %v, err: %v", found, err)
+	}
+	args := loaded.Args()
+	for i, v := range vals {
+		if args[i] != v {
+			t.Errorf("Round trip: expected %+q at %d, got %+q", v.String, i, args[i].(sql.NullString).String)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	cp := New("`db`.`t`", "dt_id", []string{"dt", "dt", "id"}, boundary)
+	if err := cp.Matches("`db`.`t`", "dt_id", []string{"dt", "dt", "id"}); err != nil {
+		t.Errorf("Matches returned an error: %v", err)
+	}
+	if err := cp.Matches("`db`.`t`", "PRIMARY", []string{"id"}); err == nil {
+		t.Errorf("Matches on a different index didn't return an error")
+	}
+	if err := cp.Matches("`db`.`t2`", "dt_id", []string{"dt", "dt", "id"}); err == nil {
+		t.Errorf("Matches on a different table didn't return an error")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	fst := FileStore{File: filepath.Join(t.TempDir(), "checkpoint")}
+	{
+		// No checkpoint yet
+		_, found, err := fst.Load()
+		if found || err != nil {
+			t.Errorf("Load without a file: expected nothing, got found: %v, err: %v", found, err)
+		}
+	}
+	{
+		cp := New("`db`.`t`", "dt_id", []string{"dt", "dt", "id"}, boundary)
+		if err := fst.Save(cp); err != nil {
+			t.Fatalf("Save returned an error: %v", err)
+		}
+		// Overwritten by the next save
+		cp.Values[0] = nil
+		if err := fst.Save(cp); err != nil {
+			t.Fatalf("Save returned an error: %v", err)
+		}
+		loaded, found, err := fst.Load()
+		if !found || err != nil {
+			t.Errorf("Load: expected a checkpoint, got found: %v, err: %v", found, err)
+		}
+		if !reflect.DeepEqual(loaded, cp) {
+			t.Errorf("Load: expected %v, got %v", cp, loaded)
+		}
+		// No temporary file left
+		files, _ := os.ReadDir(filepath.Dir(fst.File))
+		if len(files) != 1 {
+			t.Errorf("Save: expected 1 file, got %d", len(files))
+		}
+	}
+	{
+		if err := fst.Clear(); err != nil {
+			t.Errorf("Clear returned an error: %v", err)
+		}
+		if err := fst.Clear(); err != nil {
+			t.Errorf("Clear without a file returned an error: %v", err)
+		}
+	}
+	{
+		// Corrupted file
+		os.WriteFile(fst.File, []byte("{"), 0644)
+		if _, _, err := fst.Load(); err == nil {
+			t.Errorf("Load of an invalid file didn't return an error")
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   This package adjusts the number of rows per chunk so each chunk takes
+   about a target time. It is the equivalent of the Perl WeightedAvgRate
+   module used by pt-table-checksum and pt-online-schema-change: the rows
+   and the time of the chunks are exponentially weighted moving averages,
+   their ratio being the rate of the server.
+
+*/
+
+package chunksizer
+
+import (
+	"math"
+	"time"
+)
+
+// DefaultWeight is the weight of the past chunks in the averages
+const DefaultWeight = 0.75
+
+type Sizer struct {
+	Target time.Duration // time a chunk should take
+	Weight float64       // weight of the past chunks, 0 means DefaultWeight
+	Min    int           // minimum chunk size, at least 1
+	Max    int           // maximum chunk size, 0 means no maximum
+	avgN   float64
+	avgT   float64
+}
+
+// Update adds a chunk of n rows processed in t and returns the size of the
+// next chunk.
+func (s *Sizer) Update(n int, t time.Duration) int {
+	weight := s.Weight
+	if weight == 0 {
+		weight = DefaultWeight
+	}
+	s.avgN = s.avgN*weight + float64(n)
+	s.avgT = s.avgT*weight + t.Seconds()
+
+	size := float64(n)
+	if s.avgT > 0 {
+		size = s.avgN / s.avgT * s.Target.Seconds()
+	}
+	return s.bound(size)
+}
+
+// bound returns size rounded down within Min and Max
+func (s *Sizer) bound(size float64) int {
+	min := s.Min
+	if min < 1 {
+		min = 1
+	}
+	if size < float64(min) {
+		return min
+	}
+	if s.Max > 0 && size > float64(s.Max) {
+		return s.Max
+	}
+	if size > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(size)
+}
@@ -0,0 +1,43 @@
+package chunksizer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	{
+		// 1000 rows in 2s, target 1s
+		s := Sizer{Target: time.Second}
+		if n := s.Update(1000, 2*time.Second); n != 500 {
+			t.Errorf("Slow chunk: expected 500 rows, got %d", n)
+		}
+		// 500 rows in 0.1s, the average rate is (750+500)/(1.5+0.1)
+		if n := s.Update(500, 100*time.Millisecond); n != 781 {
+			t.Errorf("Fast chunk: expected 781 rows, got %d", n)
+		}
+	}
+	{
+		// Bounds
+		s := Sizer{Target: time.Second, Min: 10, Max: 100}
+		if n := s.Update(1, 10*time.Second); n != 10 {
+			t.Errorf("Min bound: expected 10 rows, got %d", n)
+		}
+		s = Sizer{Target: time.Second, Min: 10, Max: 100}
+		if n := s.Update(1000, time.Millisecond); n != 100 {
+			t.Errorf("Max bound: expected 100 rows, got %d", n)
+		}
+	}
+	{
+		// No time measured, the size is kept
+		s := Sizer{Target: time.Second}
+		if n := s.Update(42, 0); n != 42 {
+			t.Errorf("No time: expected 42 rows, got %d", n)
+		}
+		// Empty chunk, at least one row
+		s = Sizer{Target: time.Second}
+		if n := s.Update(0, time.Second); n != 1 {
+			t.Errorf("Empty chunk: expected 1 row, got %d", n)
+		}
+	}
+}
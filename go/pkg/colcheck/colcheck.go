@@ -0,0 +1,240 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   This package compares the columns of the table rows are copied from with
+   the columns of the table they are inserted in. It reports the columns
+   that would be lost, the dest columns that can't be left out of the
+   INSERT, the types that can't hold the source values and the generated
+   dest columns, which are computed by the server instead of copied.
+
+*/
+
+package colcheck
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/y-trudeau/go-toolkit/go/pkg/tableparser"
+)
+
+// Kinds of findings
+const (
+	Missing   = "missing"   // source column not in dest, its values are lost
+	Extra     = "extra"     // dest column not in source, set to its default
+	NotNull   = "not null"  // dest column not in source without a default
+	Type      = "type"      // dest type can't hold all the source values
+	Generated = "generated" // dest column computed by the server
+)
+
+type Finding struct {
+	Column string
+	Kind   string
+	Detail string
+	Fatal  bool // the rows can't be copied as is
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%v: `%v` %v", f.Kind, f.Column, f.Detail)
+}
+
+type Report []Finding
+
+// Fatal returns whether a finding prevents copying the rows
+func (r Report) Fatal() bool {
+	for _, f := range r {
+		if f.Fatal {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the findings, one per line
+func (r Report) String() string {
+	lines := make([]string, len(r))
+	for i, f := range r {
+		lines[i] = "  " + f.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Compare compares the columns cols of src with the columns of dst
+func Compare(src tableparser.TableInfo, cols []string, dst tableparser.TableInfo) Report {
+	var r Report
+	for _, col := range cols {
+		switch {
+		case !dst.ColExists(col):
+			r = append(r, Finding{col, Missing, "exists in the source but not in dest", true})
+		case dst.ColIsGenerated(col):
+			r = append(r, Finding{col, Generated, "is generated in dest, it is excluded from the INSERT", false})
+		default:
+			if detail := compareTypes(src, dst, col); len(detail) > 0 {
+				r = append(r, Finding{col, Type, detail, true})
+			}
+		}
+	}
+	for _, col := range dst.GetCols() {
+		if slices.Contains(cols, col) || dst.ColIsGenerated(col) {
+			continue
+		}
+		if dst.ColNullable(col) || dst.ColHasDefault(col) || dst.ColIsAutoinc(col) {
+			r = append(r, Finding{col, Extra, "exists in dest but not in the source, it is set to its default", false})
+		} else {
+			r = append(r, Finding{col, NotNull, "is NOT NULL in dest without a default and is not in the source", true})
+		}
+	}
+	return r
+}
+
+// Capacity ranks of the types of a family, a larger type holds all the
+// values of a smaller one.
+var (
+	intRanks   = map[string]int{"tinyint": 1, "smallint": 2, "mediumint": 3, "int": 4, "integer": 4, "bigint": 5}
+	floatRanks = map[string]int{"float": 1, "double": 2, "real": 2}
+	textSizes  = map[string]int64{"tinytext": 1<<8 - 1, "text": 1<<16 - 1, "mediumtext": 1<<24 - 1, "longtext": 1<<32 - 1}
+	blobSizes  = map[string]int64{"tinyblob": 1<<8 - 1, "blob": 1<<16 - 1, "mediumblob": 1<<24 - 1, "longblob": 1<<32 - 1}
+)
+
+// Splits "decimal(10,2)" in "decimal" and ["10", "2"]
+var reType = regexp.MustCompile(`^([a-z]+)(?:\((.*?)\)?)?$`)
+
+func splitType(dataType string) (string, []string) {
+	m := reType.FindStringSubmatch(strings.ToLower(dataType))
+	if m == nil {
+		return strings.ToLower(dataType), nil
+	}
+	if len(m[2]) == 0 {
+		return m[1], nil
+	}
+	return m[1], strings.Split(m[2], ",")
+}
+
+// arg returns the integer argument i of a type, def if it has none
+func arg(args []string, i int, def int) int {
+	if i < len(args) {
+		if n, err := strconv.Atoi(strings.TrimSpace(args[i])); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// compareTypes returns why the dest type of col can't hold all the source
+// values, an empty string if it can.
+func compareTypes(src, dst tableparser.TableInfo, col string) string {
+	srcType, dstType := src.ColType(col), dst.ColType(col)
+	srcUnsigned, dstUnsigned := src.ColIsUnsigned(col), dst.ColIsUnsigned(col)
+	if strings.EqualFold(srcType, dstType) && srcUnsigned == dstUnsigned {
+		return ""
+	}
+	srcBase, srcArgs := splitType(srcType)
+	dstBase, dstArgs := splitType(dstType)
+	incompatible := fmt.Sprintf("is %v in the source and %v in dest", describe(srcType, srcUnsigned), describe(dstType, dstUnsigned))
+	narrower := incompatible + ", values may not fit"
+
+	switch {
+	case intRanks[srcBase] > 0 && intRanks[dstBase] > 0:
+		srcRank, dstRank := intRanks[srcBase], intRanks[dstBase]
+		if dstUnsigned && !srcUnsigned {
+			return narrower
+		}
+		if srcUnsigned && !dstUnsigned {
+			srcRank++ // needs the next signed type
+		}
+		if dstRank < srcRank {
+			return narrower
+		}
+	case isDecimal(srcBase) && isDecimal(dstBase):
+		srcScale, dstScale := arg(srcArgs, 1, 0), arg(dstArgs, 1, 0)
+		if dstScale < srcScale || arg(dstArgs, 0, 10)-dstScale < arg(srcArgs, 0, 10)-srcScale {
+			return narrower
+		}
+		if dstUnsigned && !srcUnsigned {
+			return narrower
+		}
+	case floatRanks[srcBase] > 0 && floatRanks[dstBase] > 0:
+		if floatRanks[dstBase] < floatRanks[srcBase] || (dstUnsigned && !srcUnsigned) {
+			return narrower
+		}
+	case isChar(srcBase) && isChar(dstBase):
+		if charSize(dstBase, dstArgs, textSizes) < charSize(srcBase, srcArgs, textSizes) {
+			return narrower
+		}
+	case isBinary(srcBase) && isBinary(dstBase):
+		if charSize(dstBase, dstArgs, blobSizes) < charSize(srcBase, srcArgs, blobSizes) {
+			return narrower
+		}
+	case isDate(srcBase) && isDate(dstBase):
+		// datetime has the widest range and keeps the time
+		if (dstBase != srcBase && dstBase != "datetime") || arg(dstArgs, 0, 0) < arg(srcArgs, 0, 0) {
+			return narrower
+		}
+	case srcBase == dstBase && (srcBase == "enum" || srcBase == "set"):
+		for _, v := range srcArgs {
+			if !slices.Contains(dstArgs, v) {
+				return fmt.Sprintf("%v, %v is not a value of dest", incompatible, v)
+			}
+		}
+	case srcBase == dstBase && srcBase == "bit":
+		if arg(dstArgs, 0, 1) < arg(srcArgs, 0, 1) {
+			return narrower
+		}
+	case srcBase == dstBase && srcBase == "time":
+		if arg(dstArgs, 0, 0) < arg(srcArgs, 0, 0) {
+			return narrower
+		}
+	case srcBase == dstBase && srcUnsigned == dstUnsigned:
+		// Same type, only the display width differs
+	default:
+		return incompatible
+	}
+	return ""
+}
+
+func describe(dataType string, unsigned bool) string {
+	if unsigned {
+		return dataType + " unsigned"
+	}
+	return dataType
+}
+
+func isDecimal(base string) bool {
+	return base == "decimal" || base == "numeric" || base == "dec" || base == "fixed"
+}
+
+func isDate(base string) bool {
+	return base == "date" || base == "datetime" || base == "timestamp"
+}
+
+func isChar(base string) bool {
+	return base == "char" || base == "varchar" || textSizes[base] > 0
+}
+
+func isBinary(base string) bool {
+	return base == "binary" || base == "varbinary" || blobSizes[base] > 0
+}
+
+// charSize returns the maximum length of a string type
+func charSize(base string, args []string, sizes map[string]int64) int64 {
+	if size, ok := sizes[base]; ok {
+		return size
+	}
+	return int64(arg(args, 0, 1))
+}
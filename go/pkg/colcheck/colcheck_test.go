@@ -0,0 +1,147 @@
+package colcheck
+
+import (
+	"testing"
+
+	"github.com/y-trudeau/go-toolkit/go/pkg/tableparser"
+)
+
+const srcTable = "CREATE TABLE `src` (\n" +
+	"  `id` int unsigned NOT NULL AUTO_INCREMENT,\n" +
+	"  `name` varchar(64) NOT NULL,\n" +
+	"  `amount` decimal(10,2) DEFAULT NULL,\n" +
+	"  `created` datetime NOT NULL,\n" +
+	"  `status` enum('new','done') NOT NULL,\n" +
+	"  `note` text NOT NULL,\n" +
+	"  PRIMARY KEY (`id`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4\n"
+
+// Same columns, wider types
+const wideTable = "CREATE TABLE `dst` (\n" +
+	"  `id` bigint NOT NULL,\n" +
+	"  `name` varchar(255) NOT NULL,\n" +
+	"  `amount` decimal(12,3) DEFAULT NULL,\n" +
+	"  `created` datetime(3) NOT NULL,\n" +
+	"  `status` enum('new','done','purged') NOT NULL,\n" +
+	"  `note` mediumtext NOT NULL,\n" +
+	"  PRIMARY KEY (`id`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4\n"
+
+// Narrower types, extra and generated columns
+const narrowTable = "CREATE TABLE `dst` (\n" +
+	"  `id` int NOT NULL,\n" +
+	"  `name` varchar(32) NOT NULL,\n" +
+	"  `amount` decimal(10,1) DEFAULT NULL,\n" +
+	"  `created` timestamp NOT NULL,\n" +
+	"  `status` enum('new') NOT NULL,\n" +
+	"  `archived` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,\n" +
+	"  `batch` int NOT NULL,\n" +
+	"  `note` varchar(100) GENERATED ALWAYS AS (left(`name`,100)) VIRTUAL,\n" +
+	"  PRIMARY KEY (`id`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4\n"
+
+func mustParse(t *testing.T, ddl string) tableparser.TableInfo {
+	t.Helper()
+	tbl, err := tableparser.Parse(ddl)
+	if err != nil {
+		t.Fatalf("Parse returned an error: %v", err)
+	}
+	return tbl
+}
+
+func TestCompare(t *testing.T) {
+	src := mustParse(t, srcTable)
+	{
+		// Same table
+		r := Compare(src, src.GetCols(), src)
+		if len(r) != 0 {
+			t.Errorf("Same table: expected no finding, got\n%v", r)
+		}
+	}
+	{
+		// Wider types are compatible
+		r := Compare(src, src.GetCols(), mustParse(t, wideTable))
+		if len(r) != 0 {
+			t.Errorf("Wider table: expected no finding, got\n%v", r)
+		}
+	}
+	{
+		r := Compare(src, src.GetCols(), mustParse(t, narrowTable))
+		kinds := make(map[string]string)
+		for _, f := range r {
+			kinds[f.Column] = f.Kind
+		}
+		want := map[string]string{
+			"id":       Type,
+			"name":     Type,
+			"amount":   Type,
+			"created":  Type,
+			"status":   Type,
+			"note":     Generated,
+			"archived": Extra,
+			"batch":    NotNull,
+		}
+		for col, kind := range want {
+			if kinds[col] != kind {
+				t.Errorf("Narrow table: expected %v for `%v`, got '%v'", kind, col, kinds[col])
+			}
+		}
+		if len(r) != len(want) {
+			t.Errorf("Narrow table: expected %d findings, got\n%v", len(want), r)
+		}
+		if !r.Fatal() {
+			t.Errorf("Narrow table: expected a fatal report")
+		}
+	}
+	{
+		// Missing column, the generated column alone isn't fatal
+		dst := mustParse(t, narrowTable)
+		r := Compare(src, []string{"note", "missing"}, dst)
+		if len(r) < 2 || r[0].Kind != Generated || r[1].Kind != Missing {
+			t.Errorf("Missing column: unexpected findings\n%v", r)
+		}
+		r = Report{r[0], {"archived", Extra, "", false}}
+		if r.Fatal() {
+			t.Errorf("Generated and extra columns: unexpected fatal report\n%v", r)
+		}
+	}
+}
+
+func TestCompareTypes(t *testing.T) {
+	table := func(colType string) tableparser.TableInfo {
+		return mustParse(t, "CREATE TABLE `t` (\n  `c` "+colType+" NOT NULL\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4\n")
+	}
+	cases := []struct {
+		src, dst string
+		ok       bool
+	}{
+		{"int(11)", "int", true},
+		{"int unsigned", "int", false},
+		{"int unsigned", "bigint", true},
+		{"int", "int unsigned", false},
+		{"smallint", "int", true},
+		{"bigint", "int", false},
+		{"decimal(10,2)", "decimal(11,2)", true},
+		{"decimal(10,2)", "decimal(10,3)", false},
+		{"float", "double", true},
+		{"double", "float", false},
+		{"char(10)", "varchar(10)", true},
+		{"varchar(300)", "tinytext", false},
+		{"tinytext", "varchar(255)", true},
+		{"varbinary(10)", "blob", true},
+		{"blob", "text", false},
+		{"date", "datetime", true},
+		{"datetime", "timestamp", false},
+		{"datetime(6)", "datetime", false},
+		{"set('a','b')", "set('a','b','c')", true},
+		{"bit(8)", "bit(1)", false},
+		{"json", "json", true},
+		{"int", "varchar(20)", false},
+	}
+	for _, c := range cases {
+		detail := compareTypes(table(c.src), table(c.dst), "c")
+		if (len(detail) == 0) != c.ok {
+			t.Errorf("compareTypes %v to %v: expected compatible %v, got '%v'", c.src, c.dst, c.ok, detail)
+		}
+	}
+}
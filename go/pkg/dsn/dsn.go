@@ -35,7 +35,9 @@
 
    h  MySQL hostname or IP address to connect to.
 
-   L  Explicitly enable LOAD DATA LOCAL INFILE.
+   L  Explicitly enable LOAD DATA LOCAL INFILE from any file, true/false, default
+      is false (uses strconv.ParseBool). Reader handlers registered with
+      mysql.RegisterReaderHandler don't need it.
 
    p  MySQL password to use when connecting.
 
@@ -72,9 +74,11 @@ import (
 )
 
 type Dsn struct {
-    SkipBinlog   string
+    Charset      string
+    SkipBinlog   bool
     Database     string
     Host         string
+    LoadLocal    bool
     Password     string
     Port         uint16
     Setvars      string
@@ -111,7 +115,7 @@ func SplitAtCommas(s string) []string {
 func Validate(dsnValue string) error {
 	params := SplitAtCommas(dsnValue)
 
-	re := regexp.MustCompile(`^(A|b|D|F|h|L|p|P|s|S|u|v|x){1}$`)
+	re := regexp.MustCompile(`^(A|b|D|F|h|L|p|P|s|S|t|u|v|x){1}$`)
 
 	for i := 0; i < len(params); i++ {
 		// Each parameter must have an '=' sign (maybe more than one but al least one)
@@ -145,9 +149,11 @@ func Validate(dsnValue string) error {
 }
 
 func (D *Dsn) init() {
+    D.Charset = "utf8mb4"
     D.SkipBinlog = false
     D.Database = ""
     D.Host = ""
+    D.LoadLocal = false
     D.Password = ""
     D.Port = 3306
     D.Socket = ""
@@ -171,7 +177,7 @@ func (D *Dsn) Parse(dsnValue string) error {
 	params := SplitAtCommas(dsnValue)
 	for i := 0; i < len(params); i++ {
 		// we now split around '='
-		pSplit := strings.Split(params[i], "=")
+		pSplit := strings.SplitN(params[i], "=", 2)
         debug.Print("Parsing :" + pSplit[0] + " = " + pSplit[1])
 
 		switch pSplit[0] {
@@ -204,8 +210,11 @@ func (D *Dsn) Parse(dsnValue string) error {
             }
         case "v":
             // must be parsed by "`([a-z0-9_]*)=('[a-z0-9_\-,= ]*'|[a-z0-9]*),?`gm"
-            if len(D.SetVars) > 0 {
-                D.SetVars = D.SetVars + "," + strings.Replace(pSplit[1],"\"",'"',-1)
+            vars := strings.ReplaceAll(strings.Trim(pSplit[1], `"`), `\"`, `"`)
+            if len(D.Setvars) > 0 {
+                D.Setvars = D.Setvars + "," + vars
+            } else {
+                D.Setvars = vars
             }
 
         case "s":
@@ -220,6 +229,12 @@ func (D *Dsn) Parse(dsnValue string) error {
 			D.User = pSplit[1]
 		case "x":
 			D.Extra = pSplit[1]
+		case "L":
+            var err error
+            D.LoadLocal, err = strconv.ParseBool(pSplit[1])
+            if err != nil {
+                 return fmt.Errorf("Failed to parse '%v' as boolean for parameter 'L'", pSplit[1])
+            }
 		}
 	}
 	return nil
@@ -256,29 +271,30 @@ func (D *Dsn) genUri() string {
         } else {
             Uri = Uri + "localhost:" + strconv.Itoa(int(D.Port))
         }
+        Uri = Uri + ")"
     }
-    Uri = Uri + ")/"
+    Uri = Uri + "/"
 
     if len(D.Database) > 0 {
         Uri = Uri + D.Database
     }
 
     // Process the variables after
-    if D.Ssl || len(D.Extra) > 0 {
-        // one or both settings are enabled
-        Uri = Uri + "?"
-
-        if D.Ssl {
-            Uri = Uri + "allowFallbackToPlaintext=false,tls=true"
-        }
-
-        if D.Ssl && len(D.Extra) > 0 {
-            Uri = Uri + ","
-        }
-
-        if len(D.Extra) > 0 {
-            Uri = Uri + D.Extra
-        }
+    var params []string
+    if D.Ssl {
+        params = append(params, "allowFallbackToPlaintext=false&tls=true")
+    }
+    if D.LoadLocal {
+        params = append(params, "allowAllFiles=true")
+    }
+    if len(D.Charset) > 0 {
+        params = append(params, "charset=" + D.Charset)
+    }
+    if len(D.Extra) > 0 {
+        params = append(params, D.Extra)
+    }
+    if len(params) > 0 {
+        Uri = Uri + "?" + strings.Join(params, "&")
     }
     debug.Print("Generated Uri = '" + Uri + "'")
     return Uri
@@ -297,15 +313,18 @@ func (D *Dsn) Getconn() (*sql.DB, error) {
 
         if D.SkipBinlog {
             debug.Print("Skipping binary logging")
-            _, err = D.Dbh.Query("SET SQL_LOG_BIN = 0;")
+            _, err = D.Dbh.Exec("SET SQL_LOG_BIN = 0;")
             if err != nil {
                 return nil, err
             }
         }
         vars := strings.Split(D.Setvars, ",")
-        for i := 0; i < len(vars)-1; i++ {
+        for i := 0; i < len(vars); i++ {
             debug.Print("Setting variable '" + vars[i] + "'")
-            _, err = D.Dbh.Query("SET " + vars[i] + ";")
+            if len(vars[i]) == 0 {
+                continue
+            }
+            _, err = D.Dbh.Exec("SET " + vars[i] + ";")
             if err != nil {
                 return nil, err
             }
@@ -324,9 +343,12 @@ func (D *Dsn) Getconn() (*sql.DB, error) {
             D.Dbh.SetMaxOpenConns(1)
 
             vars := strings.Split(D.Setvars, ",")
-            for i := 0; i < len(vars)-1; i++ {
+            for i := 0; i < len(vars); i++ {
                 debug.Print("Setting variable '" + vars[i] + "'")
-                _, err = D.Dbh.Query("SET " + vars[i] + ";")
+                if len(vars[i]) == 0 {
+                    continue
+                }
+                _, err = D.Dbh.Exec("SET " + vars[i] + ";")
                 if err != nil {
                     return nil, err
                 }
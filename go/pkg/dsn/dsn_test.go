@@ -1,4 +1,4 @@
-package dsn
+package dsn_test
 
 import (
 	"testing"
@@ -154,6 +154,24 @@ func TestParse(t *testing.T) {
 			t.Errorf("Parse didn't set the correct myuser, got '%v'", d.User)
 		}
 	}
+	{
+		// Test LoadLocal parsing
+		d := dsn.Dsn{}
+		d.Parse("L=true")
+
+		if !d.LoadLocal {
+			t.Errorf("Parse didn't set the correct LoadLocal, got '%v'", d.LoadLocal)
+		}
+	}
+	{
+		// Test Table parsing
+		d := dsn.Dsn{}
+		err := d.Parse("D=testing,t=mytable")
+
+		if err != nil || d.Table != "mytable" {
+			t.Errorf("Parse didn't set the correct Table, got '%v', err: %v", d.Table, err)
+		}
+	}
 	{
 		// Test multiple params
 		d := dsn.Dsn{}
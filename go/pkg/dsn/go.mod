@@ -2,8 +2,10 @@ module github.com/y-trudeau/go-toolkit/go/pkg/dsn
 
 go 1.24.3
 
-replace github.com/y-trudeau/go-toolkit/go/pkg/debug => /home/yves/src/go-toolkit/go/pkg/debug
+replace github.com/y-trudeau/go-toolkit/go/pkg/debug => ../debug
 
 require github.com/go-sql-driver/mysql v1.9.2
-require github.com/y-trudeau/go-toolkit/go/pkg/debug v0.0.0-20250625155247-5604a5fa587c // indirect
+
+require github.com/y-trudeau/go-toolkit/go/pkg/debug v0.0.0-20250625155247-5604a5fa587c
+
 require filippo.io/edwards25519 v1.1.0 // indirect
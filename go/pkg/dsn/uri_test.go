@@ -0,0 +1,41 @@
+package dsn
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenUri(t *testing.T) {
+	{
+		// Defaults: utf8mb4, SSL and parseTime
+		d := Dsn{}
+		d.Parse("h=db1,u=bob,p=secret,D=test")
+		e := "bob:secret@tcp(db1:3306)/test?allowFallbackToPlaintext=false&tls=true&charset=utf8mb4&parseTime=true"
+		if r := d.genUri(); r != e {
+			t.Errorf("genUri: expected '%v', got '%v'", e, r)
+		}
+	}
+	{
+		// L enables allowAllFiles, the extra parameters are joined after it
+		sock := filepath.Join(t.TempDir(), "mysql.sock")
+		os.WriteFile(sock, nil, 0600)
+		d := Dsn{}
+		if err := d.Parse("S=" + sock + ",s=false,L=true,A=latin1,x=parseTime=false&timeout=5s"); err != nil {
+			t.Fatalf("Parse returned an error: %v", err)
+		}
+		e := "@unix(" + sock + ")/?allowAllFiles=true&charset=latin1&parseTime=false&timeout=5s"
+		if r := d.genUri(); r != e {
+			t.Errorf("genUri with L: expected '%v', got '%v'", e, r)
+		}
+	}
+	{
+		// No parameter at all
+		d := Dsn{}
+		d.Parse("h=db1,s=false,A=,x=")
+		e := "@tcp(db1:3306)/"
+		if r := d.genUri(); r != e {
+			t.Errorf("genUri without parameters: expected '%v', got '%v'", e, r)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   This package writes the archived rows to a file named from a template
+   with the tags of the MySQL DATE_FORMAT function, like the --file option
+   of the Perl pt-archiver:
+
+   %d  Day of the month, numeric (01..31)
+   %H  Hour (00..23)
+   %i  Minutes, numeric (00..59)
+   %m  Month, numeric (01..12)
+   %s  Seconds (00..59)
+   %Y  Year, numeric, four digits
+   %D  Database name
+   %t  Table name
+
+   The files are opened in append mode. They are compressed with gzip when
+   their name ends with .gz and with zstd when it ends with .zst. The rows
+   are flushed and the file synced on Commit, where
+   the file is also rotated when it exceeds a size or when the expanded
+   name changes.
+
+*/
+
+package filesink
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"go-toolkit/pkg/outfile"
+)
+
+var reTag = regexp.MustCompile(`%[dHimsYDt]`)
+
+// Expand returns the template with the tags replaced
+func Expand(template string, t time.Time, db string, table string) string {
+	return reTag.ReplaceAllStringFunc(template, func(tag string) string {
+		switch tag[1] {
+		case 'd':
+			return fmt.Sprintf("%02d", t.Day())
+		case 'H':
+			return fmt.Sprintf("%02d", t.Hour())
+		case 'i':
+			return fmt.Sprintf("%02d", t.Minute())
+		case 'm':
+			return fmt.Sprintf("%02d", int(t.Month()))
+		case 's':
+			return fmt.Sprintf("%02d", t.Second())
+		case 'Y':
+			return strconv.Itoa(t.Year())
+		case 'D':
+			return db
+		}
+		return table
+	})
+}
+
+type Sink struct {
+	Template string           // file name with the DATE_FORMAT tags
+	Database string           // %D
+	Table    string           // %t
+	Format   string           // output format, see outfile.GetFormat
+	Header   []string         // column names written at the top of the new files, nil for none
+	MaxSize  int64            // rotate once the file reaches this size in bytes, 0 for no limit
+	Rotate   bool             // rotate when the expanded name changes
+	Now      func() time.Time // nil means time.Now
+
+	name string // expanded template of the opened file
+	seq  int    // sequence number of the file, for the size rotation
+	file *os.File
+	size *counter
+	comp compressor
+	out  *outfile.OutfileDest
+}
+
+// counter counts the bytes written to the file
+type counter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// compressor compresses the rows before they are written to the file
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// plain doesn't compress
+type plain struct {
+	io.Writer
+}
+
+func (plain) Flush() error { return nil }
+func (plain) Close() error { return nil }
+
+// Compression returns the compression used for a file, "gzip", "zstd" or an
+// empty string.
+func Compression(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return "gzip"
+	case strings.HasSuffix(name, ".zst"), strings.HasSuffix(name, ".zstd"):
+		return "zstd"
+	}
+	return ""
+}
+
+// Check returns an error if the file can't be written, the format being
+// unknown for instance.
+func (s *Sink) Check() error {
+	_, err := outfile.GetFormat(s.Format)
+	return err
+}
+
+// Name returns the name of the opened file, the name of the next file if
+// none is opened.
+func (s *Sink) Name() string {
+	if s.file != nil {
+		return s.file.Name()
+	}
+	return s.fileName(s.expand(), s.seq)
+}
+
+func (s *Sink) expand() string {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	return Expand(s.Template, now(), s.Database, s.Table)
+}
+
+// fileName inserts the sequence number before the extensions, "rows.txt.gz"
+// becoming "rows.1.txt.gz".
+func (s *Sink) fileName(name string, seq int) string {
+	if seq == 0 {
+		return name
+	}
+	ext := ""
+	if Compression(name) != "" {
+		ext = filepath.Ext(name)
+	}
+	ext = filepath.Ext(strings.TrimSuffix(name, ext)) + ext
+	return strings.TrimSuffix(name, ext) + "." + strconv.Itoa(seq) + ext
+}
+
+// open opens the file, the header is only written when it is created
+func (s *Sink) open() error {
+	name := s.expand()
+	if name != s.name {
+		s.name = name
+		s.seq = 0
+	}
+	// Skip the files already full, from a previous run
+	var size int64
+	for {
+		st, err := os.Stat(s.fileName(s.name, s.seq))
+		if err != nil {
+			break
+		}
+		size = st.Size()
+		if s.MaxSize == 0 || size < s.MaxSize {
+			break
+		}
+		s.seq++
+		size = 0
+	}
+
+	var err error
+	s.file, err = os.OpenFile(s.fileName(s.name, s.seq), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open the file '%v': %v", s.fileName(s.name, s.seq), err)
+	}
+	s.size = &counter{w: s.file, n: size}
+	if err := s.openCompressor(); err != nil {
+		return err
+	}
+	if s.Header != nil && size == 0 {
+		return s.out.WriteHeader(s.Header)
+	}
+	return nil
+}
+
+// openCompressor starts the compression of the file at its end, a new gzip
+// member or zstd frame when appending to an existing file.
+func (s *Sink) openCompressor() error {
+	var err error
+	switch Compression(s.name) {
+	case "gzip":
+		s.comp = gzip.NewWriter(s.size)
+	case "zstd":
+		if s.comp, err = zstd.NewWriter(s.size); err != nil {
+			return fmt.Errorf("Unable to compress to '%v': %v", s.file.Name(), err)
+		}
+	default:
+		s.comp = plain{s.size}
+	}
+	s.out, err = outfile.NewOutfileDest(s.comp, s.Format)
+	return err
+}
+
+// Write writes the rows, the file is opened if needed
+func (s *Sink) Write(rows [][]sql.NullString) error {
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	} else if s.out == nil {
+		if err := s.openCompressor(); err != nil {
+			return err
+		}
+	}
+	return s.out.Write(rows)
+}
+
+// Flush writes the buffered rows to the file, the file isn't synced
+func (s *Sink) Flush() error {
+	if s.out == nil {
+		return nil
+	}
+	if err := s.out.Flush(); err != nil {
+		return err
+	}
+	return s.comp.Flush()
+}
+
+// Commit flushes the rows, syncs the file and closes it when it must be
+// rotated, the next file is opened by the next Write.
+func (s *Sink) Commit() error {
+	if s.file == nil {
+		return nil
+	}
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync '%v': %v", s.file.Name(), err)
+	}
+
+	full := s.MaxSize > 0 && s.size.n >= s.MaxSize
+	renamed := s.Rotate && s.expand() != s.name
+	if !full && !renamed {
+		return nil
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	if full {
+		s.seq++
+	}
+	return nil
+}
+
+// Close flushes the rows, ends the compression and closes the file
+func (s *Sink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	var err error
+	if s.out != nil {
+		if err = s.out.Flush(); err == nil {
+			err = s.comp.Close()
+		}
+	}
+	if syncErr := s.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	s.comp = nil
+	s.out = nil
+	return err
+}
@@ -0,0 +1,151 @@
+package filesink
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var when = time.Date(2024, 3, 7, 5, 4, 9, 0, time.UTC)
+
+func rows(vals ...string) [][]sql.NullString {
+	var r [][]sql.NullString
+	for _, v := range vals {
+		r = append(r, []sql.NullString{{String: v, Valid: true}})
+	}
+	return r
+}
+
+func TestExpand(t *testing.T) {
+	got := Expand("/tmp/%Y-%m-%d-%H%i%s-%D.%t.txt", when, "db", "t")
+	if got != "/tmp/2024-03-07-050409-db.t.txt" {
+		t.Errorf("Expand: unexpected name '%v'", got)
+	}
+	// The names are not expanded
+	got = Expand("%D-%t", when, "%d", "%Y")
+	if got != "%d-%Y" {
+		t.Errorf("Expand of the names: unexpected name '%v'", got)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	now := when
+	s := Sink{Template: filepath.Join(dir, "%H%i.txt"), Header: []string{"c"}, MaxSize: 8, Rotate: true,
+		Now: func() time.Time { return now }}
+	{
+		// Rotated by size, the header is in each file
+		if err := s.Write(rows("aaaa", "bbbb")); err != nil {
+			t.Fatalf("Write returned an error: %v", err)
+		}
+		if err := s.Commit(); err != nil {
+			t.Fatalf("Commit returned an error: %v", err)
+		}
+		if err := s.Write(rows("cccc")); err != nil {
+			t.Fatalf("Write returned an error: %v", err)
+		}
+		if s.Name() != filepath.Join(dir, "0504.1.txt") {
+			t.Errorf("Size rotation: unexpected name '%v'", s.Name())
+		}
+	}
+	{
+		// Rotated by name
+		now = now.Add(time.Minute)
+		if err := s.Commit(); err != nil {
+			t.Fatalf("Commit returned an error: %v", err)
+		}
+		if err := s.Write(rows("dddd")); err != nil {
+			t.Fatalf("Write returned an error: %v", err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close returned an error: %v", err)
+		}
+	}
+	want := map[string]string{"0504.txt": "c\naaaa\nbbbb\n", "0504.1.txt": "c\ncccc\n", "0505.txt": "c\ndddd\n"}
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != content {
+			t.Errorf("File %v: expected %q, got %q (%v)", name, content, data, err)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	{
+		// gzip, appending to an existing file adds a member
+		s := Sink{Template: filepath.Join(dir, "rows.gz")}
+		for _, v := range []string{"a", "b"} {
+			if err := s.Write(rows(v)); err != nil {
+				t.Fatalf("Write returned an error: %v", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close returned an error: %v", err)
+			}
+		}
+		f, err := os.Open(filepath.Join(dir, "rows.gz"))
+		if err != nil {
+			t.Fatalf("Open returned an error: %v", err)
+		}
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("gzip.NewReader returned an error: %v", err)
+		}
+		data, _ := io.ReadAll(zr)
+		if string(data) != "a\nb\n" {
+			t.Errorf("gzip: unexpected content %q", data)
+		}
+	}
+	{
+		// zstd, the rows are in the file after each commit and appending
+		// to an existing file adds a frame
+		name := filepath.Join(dir, "rows.zst")
+		s := Sink{Template: name}
+		if err := s.Check(); err != nil {
+			t.Fatalf("Check returned an error: %v", err)
+		}
+		var size int64
+		for _, v := range []string{"a", "b"} {
+			if err := s.Write(rows(v)); err != nil {
+				t.Fatalf("Write returned an error: %v", err)
+			}
+			if err := s.Commit(); err != nil {
+				t.Fatalf("Commit returned an error: %v", err)
+			}
+			st, err := os.Stat(name)
+			if err != nil || st.Size() <= size {
+				t.Errorf("zstd: the row %v isn't in the file after Commit", v)
+			} else {
+				size = st.Size()
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close returned an error: %v", err)
+		}
+		s.Write(rows("c"))
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close returned an error: %v", err)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatalf("Open returned an error: %v", err)
+		}
+		defer f.Close()
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatalf("zstd.NewReader returned an error: %v", err)
+		}
+		defer zr.Close()
+		data, err := io.ReadAll(zr)
+		if err != nil || string(data) != "a\nb\nc\n" {
+			t.Errorf("zstd: unexpected content %q (%v)", data, err)
+		}
+	}
+}
@@ -18,40 +18,154 @@
    https://dev.mysql.com/doc/refman/8.0/en/load-data.html  for more
    details
 
+   Two formats are supported:
+
+   dump: FIELDS TERMINATED BY '\t' ESCAPED BY '\\' LINES TERMINATED BY '\n'
+   csv : FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '"' ESCAPED BY '\\'
+         LINES TERMINATED BY '\n'
+
 */
 
 package outfile
 
 import (
-	// "errors"
-	// "fmt"
-	// "regexp"
-	// "strconv"
-	// "strings"
 	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
 )
 
+// Format holds the FIELDS and LINES options of a LOAD DATA INFILE statement
+type Format struct {
+	Name        string
+	TerminateBy byte // FIELDS TERMINATED BY
+	EncloseBy   byte // FIELDS OPTIONALLY ENCLOSED BY, 0 when fields are not enclosed
+	EscapeBy    byte // FIELDS ESCAPED BY
+	LineEnd     byte // LINES TERMINATED BY
+}
+
+// Dump is the default format of SELECT INTO OUTFILE and pt-archiver
+var Dump = Format{Name: "dump", TerminateBy: '\t', EncloseBy: 0, EscapeBy: '\\', LineEnd: '\n'}
+
+// Csv separates the fields with commas and encloses the non-numeric values
+var Csv = Format{Name: "csv", TerminateBy: ',', EncloseBy: '"', EscapeBy: '\\', LineEnd: '\n'}
+
+// Values matching this regex are numbers and are not enclosed
+var reNumeric = regexp.MustCompile(`^[-+]?[0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?$`)
+
+// GetFormat returns the format named as in --output-format
+func GetFormat(name string) (Format, error) {
+	switch name {
+	case "", "dump":
+		return Dump, nil
+	case "csv":
+		return Csv, nil
+	}
+	return Format{}, fmt.Errorf("Unknown output format '%v'", name)
+}
+
+// Clause returns the FIELDS and LINES clauses of LOAD DATA INFILE matching
+// the format.
+func (f Format) Clause() string {
+	clause := "FIELDS TERMINATED BY " + quoteByte(f.TerminateBy)
+	if f.EncloseBy != 0 {
+		clause = clause + " OPTIONALLY ENCLOSED BY " + quoteByte(f.EncloseBy)
+	}
+	return clause + " ESCAPED BY " + quoteByte(f.EscapeBy) + " LINES TERMINATED BY " + quoteByte(f.LineEnd)
+}
+
+// quoteByte returns a single character SQL string literal
+func quoteByte(b byte) string {
+	switch b {
+	case '\t':
+		return `'\t'`
+	case '\n':
+		return `'\n'`
+	case '\\':
+		return `'\\'`
+	case '\'':
+		return `'\''`
+	}
+	return "'" + string(b) + "'"
+}
+
 type OutfileDest struct {
-	OutWriter bufio.Writer
+	OutWriter *bufio.Writer
+	Format    Format
 }
 
-func (OutfileDest *ow) Write(v string) []string {
+// NewOutfileDest returns an OutfileDest writing to w using the named format
+func NewOutfileDest(w io.Writer, format string) (*OutfileDest, error) {
+	f, err := GetFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	return &OutfileDest{OutWriter: bufio.NewWriter(w), Format: f}, nil
+}
 
-	// 	my ( $self, $fh, $rows ) = @_;
-	//    foreach my $row ( @$rows ) {
-	//       print $fh escape($row), "\n"
-	//          or die "Cannot write to outfile: $OS_ERROR\n";
-	//    }
-	//    return;
+// WriteHeader writes the column names as the first line, to be skipped
+// with IGNORE 1 LINES when loading the file.
+func (ow *OutfileDest) WriteHeader(cols []string) error {
+	row := make([]sql.NullString, len(cols))
+	for i, col := range cols {
+		row[i] = sql.NullString{String: col, Valid: true}
+	}
+	return ow.Write([][]sql.NullString{row})
+}
 
+// Write writes the rows, one per line
+func (ow *OutfileDest) Write(rows [][]sql.NullString) error {
+	for _, row := range rows {
+		if _, err := ow.OutWriter.WriteString(Escape(row, ow.Format)); err != nil {
+			return fmt.Errorf("Cannot write to outfile: %v", err)
+		}
+		if err := ow.OutWriter.WriteByte(ow.Format.LineEnd); err != nil {
+			return fmt.Errorf("Cannot write to outfile: %v", err)
+		}
+	}
+	return nil
 }
 
-func escape(v string) []string {
+// Flush writes the buffered data to the underlying writer
+func (ow *OutfileDest) Flush() error {
+	return ow.OutWriter.Flush()
+}
 
-	//    my ( $row ) = @_;
-	//    return join("\t", map {
-	//       s/([\t\n\\])/\\$1/g if defined $_;  # Escape tabs etc
-	//       defined $_ ? $_ : '\N';             # NULL = \N
-	//    } @$row);
+// Escape returns a row as a line of the format, without the line terminator.
+// NULL values are written as \N, the special characters are prefixed by the
+// escape character.
+func Escape(row []sql.NullString, f Format) string {
+	fields := make([]string, len(row))
+	for i, v := range row {
+		if !v.Valid {
+			fields[i] = string(f.EscapeBy) + "N"
+			continue
+		}
+		fields[i] = escapeValue(v.String, f)
+		if f.EncloseBy != 0 && !reNumeric.MatchString(v.String) {
+			fields[i] = string(f.EncloseBy) + fields[i] + string(f.EncloseBy)
+		}
+	}
+	return strings.Join(fields, string(f.TerminateBy))
+}
 
+// escapeValue prefixes the escape, separator, enclosure and line characters
+// by the escape character. ASCII NUL is written as \0.
+func escapeValue(v string, f Format) string {
+	var sb strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == 0:
+			sb.WriteByte(f.EscapeBy)
+			sb.WriteByte('0')
+			continue
+		case c == f.EscapeBy || c == f.TerminateBy || c == f.LineEnd || (f.EncloseBy != 0 && c == f.EncloseBy):
+			sb.WriteByte(f.EscapeBy)
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
 }
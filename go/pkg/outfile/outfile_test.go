@@ -0,0 +1,228 @@
+package outfile
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func val(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: true}
+}
+
+var null = sql.NullString{}
+
+// Rows with all the characters needing to be escaped
+var trickyRows = [][]sql.NullString{
+	{val("1"), val("plain"), null},
+	{val("2"), val("tab\there"), val("new\nline")},
+	{val("3"), val(`back\slash`), val(`\N`)},
+	{val("4"), val(`"quoted", with comma`), val("")},
+	{val("-5.2e3"), val("nul\x00byte"), val(`ends with \`)},
+}
+
+// trickyRows as written in each format
+var writtenRows = map[string]string{
+	"dump": "1\tplain\t\\N\n" +
+		"2\ttab\\\there\tnew\\\nline\n" +
+		"3\tback\\\\slash\t\\\\N\n" +
+		"4\t\"quoted\", with comma\t\n" +
+		"-5.2e3\tnul\\0byte\tends with \\\\\n",
+	"csv": "1,\"plain\",\\N\n" +
+		"2,\"tab\there\",\"new\\\nline\"\n" +
+		"3,\"back\\\\slash\",\"\\\\N\"\n" +
+		"4,\"\\\"quoted\\\"\\, with comma\",\"\"\n" +
+		"-5.2e3,\"nul\\0byte\",\"ends with \\\\\"\n",
+}
+
+// loadData parses data the way LOAD DATA INFILE does with the FIELDS and
+// LINES options of f. It is only used to validate the writer output.
+func loadData(data string, f Format) ([][]sql.NullString, error) {
+	var rows [][]sql.NullString
+	var row []sql.NullString
+	var field []byte
+	enclosed, wasEnclosed, escaped, isNull := false, false, false, false
+
+	endField := func() {
+		if isNull {
+			row = append(row, null)
+		} else {
+			row = append(row, val(string(field)))
+		}
+		field = field[:0]
+		wasEnclosed, isNull = false, false
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case escaped:
+			escaped = false
+			switch c {
+			case '0':
+				field = append(field, 0)
+			case 'n':
+				field = append(field, '\n')
+			case 't':
+				field = append(field, '\t')
+			case 'N':
+				// \N is NULL only when unenclosed and alone in the field
+				if !wasEnclosed && len(field) == 0 {
+					isNull = true
+				} else {
+					field = append(field, c)
+				}
+			default:
+				field = append(field, c)
+			}
+		case c == f.EscapeBy:
+			escaped = true
+		case enclosed && c == f.EncloseBy:
+			enclosed = false
+		case enclosed:
+			field = append(field, c)
+		case f.EncloseBy != 0 && c == f.EncloseBy && len(field) == 0:
+			enclosed, wasEnclosed = true, true
+		case c == f.TerminateBy:
+			endField()
+		case c == f.LineEnd:
+			endField()
+			rows = append(rows, row)
+			row = nil
+		default:
+			field = append(field, c)
+		}
+	}
+	if escaped || enclosed || len(field) > 0 || row != nil {
+		return rows, fmt.Errorf("Unterminated line")
+	}
+	return rows, nil
+}
+
+func TestGetFormat(t *testing.T) {
+	{
+		// Default format is dump
+		f, err := GetFormat("")
+		if err != nil || f != Dump {
+			t.Errorf("Empty format expected dump, got '%v', err: %v", f.Name, err)
+		}
+	}
+	{
+		f, err := GetFormat("csv")
+		if err != nil || f != Csv {
+			t.Errorf("csv format expected csv, got '%v', err: %v", f.Name, err)
+		}
+	}
+	{
+		_, err := GetFormat("xml")
+		if err == nil {
+			t.Errorf("Unknown format 'xml' didn't return an error")
+		}
+	}
+}
+
+func TestClause(t *testing.T) {
+	{
+		r := Dump.Clause()
+		e := `FIELDS TERMINATED BY '\t' ESCAPED BY '\\' LINES TERMINATED BY '\n'`
+		if r != e {
+			t.Errorf("dump clause: expected '%v', got '%v'", e, r)
+		}
+	}
+	{
+		r := Csv.Clause()
+		e := `FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '"' ESCAPED BY '\\' LINES TERMINATED BY '\n'`
+		if r != e {
+			t.Errorf("csv clause: expected '%v', got '%v'", e, r)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	{
+		// dump format
+		r := Escape(trickyRows[1], Dump)
+		e := "2\ttab\\\there\tnew\\\nline"
+		if r != e {
+			t.Errorf("dump escape: expected %q, got %q", e, r)
+		}
+	}
+	{
+		// NULL vs the '\N' string
+		r := Escape(trickyRows[2], Dump)
+		e := `3	back\\slash	\\N`
+		if r != e {
+			t.Errorf("dump escape: expected %q, got %q", e, r)
+		}
+		r = Escape(trickyRows[0], Dump)
+		e = "1\tplain\t\\N"
+		if r != e {
+			t.Errorf("dump NULL: expected %q, got %q", e, r)
+		}
+	}
+	{
+		// csv format, numbers are not enclosed
+		r := Escape(trickyRows[3], Csv)
+		e := `4,"\"quoted\"\, with comma",""`
+		if r != e {
+			t.Errorf("csv escape: expected %q, got %q", e, r)
+		}
+		r = Escape(trickyRows[0], Csv)
+		e = `1,"plain",\N`
+		if r != e {
+			t.Errorf("csv NULL: expected %q, got %q", e, r)
+		}
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	for _, format := range []string{"dump", "csv"} {
+		var buf bytes.Buffer
+		ow, err := NewOutfileDest(&buf, format)
+		if err != nil {
+			t.Fatalf("NewOutfileDest(%v) returned an error: %v", format, err)
+		}
+		if err := ow.Write(trickyRows); err != nil {
+			t.Errorf("Write(%v) returned an error: %v", format, err)
+		}
+		if err := ow.Flush(); err != nil {
+			t.Errorf("Flush(%v) returned an error: %v", format, err)
+		}
+
+		rows, err := loadData(buf.String(), ow.Format)
+		if err != nil {
+			t.Errorf("%v output can't be loaded: %v", format, err)
+		}
+		if !reflect.DeepEqual(rows, trickyRows) {
+			t.Errorf("%v round trip: expected %v, got %v", format, trickyRows, rows)
+		}
+	}
+}
+
+func TestWriteBytes(t *testing.T) {
+	// Expected bytes of SELECT ... INTO OUTFILE with the same FIELDS and LINES options
+	for format, e := range writtenRows {
+		var buf bytes.Buffer
+		ow, _ := NewOutfileDest(&buf, format)
+		ow.Write(trickyRows)
+		ow.Flush()
+		if buf.String() != e {
+			t.Errorf("%v output: expected %q, got %q", format, e, buf.String())
+		}
+	}
+}
+
+func TestWriteHeader(t *testing.T) {
+	var buf bytes.Buffer
+	ow, _ := NewOutfileDest(&buf, "csv")
+	ow.WriteHeader([]string{"id", "name"})
+	ow.Write(trickyRows[:1])
+	ow.Flush()
+
+	e := "\"id\",\"name\"\n1,\"plain\",\\N\n"
+	if buf.String() != e {
+		t.Errorf("Header: expected %q, got %q", e, buf.String())
+	}
+}
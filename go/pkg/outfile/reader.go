@@ -0,0 +1,150 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   OutfileSource reads back the rows of files written by SELECT INTO OUTFILE
+   or by OutfileDest, following the rules of LOAD DATA INFILE.
+
+*/
+
+package outfile
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+)
+
+type OutfileSource struct {
+	InReader *bufio.Reader
+	Format   Format
+	line     int // number of lines read so far
+}
+
+// NewOutfileSource returns an OutfileSource reading from r using the named format
+func NewOutfileSource(r io.Reader, format string) (*OutfileSource, error) {
+	f, err := GetFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	return &OutfileSource{InReader: bufio.NewReader(r), Format: f}, nil
+}
+
+// ReadHeader reads the first line of a file written with a header and
+// returns the column names.
+func (or *OutfileSource) ReadHeader() ([]string, error) {
+	row, err := or.Read()
+	if err != nil {
+		return nil, err
+	}
+	cols := make([]string, len(row))
+	for i, v := range row {
+		cols[i] = v.String
+	}
+	return cols, nil
+}
+
+// Read returns the next row, io.EOF is returned when there are no more rows.
+// The last line is accepted without a line terminator.
+func (or *OutfileSource) Read() ([]sql.NullString, error) {
+	f := or.Format
+	var row []sql.NullString
+	var field []byte
+	enclosed, wasEnclosed, isNull := false, false, false
+	started := false
+
+	endField := func() {
+		if isNull {
+			row = append(row, sql.NullString{})
+		} else {
+			row = append(row, sql.NullString{String: string(field), Valid: true})
+		}
+		field = nil
+		wasEnclosed, isNull = false, false
+	}
+
+	for {
+		c, err := or.InReader.ReadByte()
+		if err == io.EOF {
+			if enclosed {
+				return nil, fmt.Errorf("Unterminated enclosed field at line %d", or.line+1)
+			}
+			if !started {
+				return nil, io.EOF
+			}
+			or.line++
+			endField()
+			return row, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		started = true
+
+		switch {
+		case c == f.EscapeBy:
+			e, err := or.InReader.ReadByte()
+			if err != nil {
+				return nil, fmt.Errorf("Unterminated escape sequence at line %d", or.line+1)
+			}
+			if e == 'N' && !wasEnclosed && !enclosed && len(field) == 0 {
+				isNull = true
+				continue
+			}
+			field = append(field, unescape(e))
+		case enclosed && c == f.EncloseBy:
+			// A doubled enclosure character is a literal one
+			next, err := or.InReader.Peek(1)
+			if err == nil && next[0] == f.EncloseBy {
+				or.InReader.ReadByte()
+				field = append(field, c)
+				continue
+			}
+			enclosed = false
+		case enclosed:
+			field = append(field, c)
+		case f.EncloseBy != 0 && c == f.EncloseBy && len(field) == 0 && !wasEnclosed:
+			enclosed, wasEnclosed = true, true
+		case c == f.TerminateBy:
+			endField()
+		case c == f.LineEnd:
+			or.line++
+			endField()
+			return row, nil
+		default:
+			field = append(field, c)
+		}
+	}
+}
+
+// unescape returns the character represented by an escape sequence
+func unescape(c byte) byte {
+	switch c {
+	case '0':
+		return 0
+	case 'b':
+		return '\b'
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'Z':
+		return 0x1a
+	}
+	return c
+}
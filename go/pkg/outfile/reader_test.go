@@ -0,0 +1,98 @@
+package outfile
+
+import (
+	"database/sql"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readAll returns all the rows read from r
+func readAll(r io.Reader, format string) ([][]sql.NullString, error) {
+	or, err := NewOutfileSource(r, format)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]sql.NullString
+	for {
+		row, err := or.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return rows, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestRead(t *testing.T) {
+	{
+		// Empty input
+		rows, err := readAll(strings.NewReader(""), "dump")
+		if err != nil || len(rows) != 0 {
+			t.Errorf("Empty input: expected no rows, got %v, err: %v", rows, err)
+		}
+	}
+	{
+		// dump with escapes and NULL, last line not terminated
+		rows, err := readAll(strings.NewReader("1\ta\\tb\t\\N\n2\tc\\\\\\r\\Z\t\\\\N"), "dump")
+		e := [][]sql.NullString{
+			{val("1"), val("a\tb"), null},
+			{val("2"), val("c\\\r\x1a"), val(`\N`)},
+		}
+		if err != nil || !reflect.DeepEqual(rows, e) {
+			t.Errorf("dump: expected %v, got %v, err: %v", e, rows, err)
+		}
+	}
+	{
+		// csv written by MySQL: doubled quotes, enclosed separators and newlines
+		rows, err := readAll(strings.NewReader("1,\"say \"\"hi\"\", ok\",\\N\n2,\"multi\nline\",\"\"\n"), "csv")
+		e := [][]sql.NullString{
+			{val("1"), val(`say "hi", ok`), null},
+			{val("2"), val("multi\nline"), val("")},
+		}
+		if err != nil || !reflect.DeepEqual(rows, e) {
+			t.Errorf("csv: expected %v, got %v, err: %v", e, rows, err)
+		}
+	}
+	{
+		// An enclosed \N is a string, not a NULL
+		rows, err := readAll(strings.NewReader("\"\\N\"\n"), "csv")
+		e := [][]sql.NullString{{val("N")}}
+		if err != nil || !reflect.DeepEqual(rows, e) {
+			t.Errorf("csv enclosed \\N: expected %v, got %v, err: %v", e, rows, err)
+		}
+	}
+	{
+		// Unterminated enclosure
+		_, err := readAll(strings.NewReader("1,\"abc\n"), "csv")
+		if err == nil || err.Error() != "Unterminated enclosed field at line 1" {
+			t.Errorf("Unterminated enclosure not detected, got: %v", err)
+		}
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	or, _ := NewOutfileSource(strings.NewReader("\"id\",\"name\"\n1,\"a\"\n"), "csv")
+	cols, err := or.ReadHeader()
+	if err != nil || !reflect.DeepEqual(cols, []string{"id", "name"}) {
+		t.Errorf("ReadHeader: expected [id name], got %v, err: %v", cols, err)
+	}
+	row, err := or.Read()
+	e := []sql.NullString{val("1"), val("a")}
+	if err != nil || !reflect.DeepEqual(row, e) {
+		t.Errorf("Read after header: expected %v, got %v, err: %v", e, row, err)
+	}
+}
+
+func TestReadWritten(t *testing.T) {
+	// The fixtures of the writer are read back
+	for format, data := range writtenRows {
+		rows, err := readAll(strings.NewReader(data), format)
+		if err != nil || !reflect.DeepEqual(rows, trickyRows) {
+			t.Errorf("%v: expected %v, got %v, err: %v", format, trickyRows, rows, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   This package retries the work failing because of a deadlock or of a lock
+   wait timeout. It is the equivalent of the Perl Retry module.
+
+*/
+
+package retry
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	ErLockWaitTimeout = 1205
+	ErLockDeadlock    = 1213
+)
+
+type Policy struct {
+	Retries int                 // number of retries after the first try
+	Backoff time.Duration       // wait Backoff times the retry number before retrying
+	Sleep   func(time.Duration) // nil means time.Sleep
+}
+
+// Retryable returns true for the MySQL errors worth retrying, deadlocks and
+// lock wait timeouts.
+func Retryable(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return myErr.Number == ErLockDeadlock || myErr.Number == ErLockWaitTimeout
+	}
+	return false
+}
+
+// Do calls try until it succeeds, fails with an error that is not
+// retryable or fails more than Retries times. Before each retry, rollback
+// is called with the error, a non-nil error returned by rollback stops the
+// retries and is returned.
+func (p Policy) Do(try func() error, rollback func(err error) error) error {
+	sleep := p.Sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	for retries := 0; ; retries++ {
+		err := try()
+		if err == nil || !Retryable(err) || retries >= p.Retries {
+			return err
+		}
+		if rollback != nil {
+			if rbErr := rollback(err); rbErr != nil {
+				return rbErr
+			}
+		}
+		sleep(p.Backoff * time.Duration(retries+1))
+	}
+}
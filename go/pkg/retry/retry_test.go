@@ -0,0 +1,85 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var deadlock = &mysql.MySQLError{Number: ErLockDeadlock, Message: "Deadlock found when trying to get lock"}
+var lockWait = &mysql.MySQLError{Number: ErLockWaitTimeout, Message: "Lock wait timeout exceeded"}
+var dupKey = &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+
+// fakeExecutor fails with the errors in sequence, then succeeds
+type fakeExecutor struct {
+	errs  []error
+	execs int
+}
+
+func (f *fakeExecutor) Exec() error {
+	f.execs++
+	if f.execs <= len(f.errs) {
+		return f.errs[f.execs-1]
+	}
+	return nil
+}
+
+func TestRetryable(t *testing.T) {
+	if !Retryable(deadlock) || !Retryable(lockWait) {
+		t.Errorf("Deadlocks and lock wait timeouts must be retryable")
+	}
+	if !Retryable(fmt.Errorf("Unable to delete: %w", deadlock)) {
+		t.Errorf("Wrapped deadlock must be retryable")
+	}
+	if Retryable(dupKey) || Retryable(errors.New("1213")) || Retryable(nil) {
+		t.Errorf("Only MySQL deadlocks and lock wait timeouts are retryable")
+	}
+}
+
+func TestDo(t *testing.T) {
+	{
+		// Succeeds after two retries
+		f := &fakeExecutor{errs: []error{deadlock, lockWait}}
+		var waits []time.Duration
+		rollbacks := 0
+		p := Policy{Retries: 2, Backoff: time.Second, Sleep: func(d time.Duration) { waits = append(waits, d) }}
+		err := p.Do(f.Exec, func(error) error { rollbacks++; return nil })
+		if err != nil || f.execs != 3 || rollbacks != 2 {
+			t.Errorf("Expected 3 executions and 2 rollbacks, got %d and %d, err: %v", f.execs, rollbacks, err)
+		}
+		if len(waits) != 2 || waits[0] != time.Second || waits[1] != 2*time.Second {
+			t.Errorf("Expected waits of 1s and 2s, got %v", waits)
+		}
+	}
+	{
+		// Retries exhausted
+		f := &fakeExecutor{errs: []error{deadlock, deadlock, deadlock}}
+		p := Policy{Retries: 1, Sleep: func(time.Duration) {}}
+		err := p.Do(f.Exec, nil)
+		if err != deadlock || f.execs != 2 {
+			t.Errorf("Expected the deadlock after 2 executions, got %d, err: %v", f.execs, err)
+		}
+	}
+	{
+		// Not retryable
+		f := &fakeExecutor{errs: []error{dupKey}}
+		p := Policy{Retries: 5, Sleep: func(time.Duration) {}}
+		err := p.Do(f.Exec, nil)
+		if err != dupKey || f.execs != 1 {
+			t.Errorf("Expected the duplicate key error after 1 execution, got %d, err: %v", f.execs, err)
+		}
+	}
+	{
+		// Rollback refusing the retry
+		f := &fakeExecutor{errs: []error{deadlock}}
+		stop := errors.New("can't replay")
+		p := Policy{Retries: 5, Sleep: func(time.Duration) {}}
+		err := p.Do(f.Exec, func(error) error { return stop })
+		if err != stop || f.execs != 1 {
+			t.Errorf("Expected the rollback error after 1 execution, got %d, err: %v", f.execs, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   This package controls running tools with sentinel files. The tool polls
+   the files between chunks: it stops when the stop sentinel exists and it
+   pauses as long as the pause sentinel exists. Many instances can then be
+   controlled from cron or any configuration management tool by creating
+   and removing the files.
+
+*/
+
+package sentinel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Content of the files created by Create
+const content = "Remove this file to permit the tools to run\n"
+
+type Sentinel struct {
+	StopFile  string              // empty disables the stop sentinel
+	PauseFile string              // empty disables the pause sentinel
+	Interval  time.Duration       // time between checks while paused
+	Sleep     func(time.Duration) // nil means time.Sleep
+	Done      <-chan struct{}     // Wait returns when closed, while paused
+	Log       io.Writer           // transitions are logged when not nil
+	OnPause   func() error        // called before pausing, to release the locks for instance
+	paused    bool
+}
+
+// exists returns true if the file exists, an empty name never exists
+func exists(file string) (bool, error) {
+	if len(file) == 0 {
+		return false, nil
+	}
+	_, err := os.Stat(file)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return false, fmt.Errorf("Unable to check the sentinel file '%v': %v", file, err)
+}
+
+// logf logs a transition
+func (s *Sentinel) logf(format string, args ...any) {
+	if s.Log != nil {
+		fmt.Fprintf(s.Log, format+"\n", args...)
+	}
+}
+
+// Wait returns true if the tool must stop. It blocks as long as the pause
+// sentinel exists, unless the stop sentinel appears or Done is closed.
+func (s *Sentinel) Wait() (bool, error) {
+	sleep := s.Sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	for {
+		stop, err := exists(s.StopFile)
+		if err != nil {
+			return false, err
+		}
+		if stop {
+			s.logf("Stopping because the sentinel file '%v' exists", s.StopFile)
+			return true, nil
+		}
+
+		pause, err := exists(s.PauseFile)
+		if err != nil {
+			return false, err
+		}
+		if !pause {
+			if s.paused {
+				s.logf("Resuming because the pause sentinel file '%v' was removed", s.PauseFile)
+				s.paused = false
+			}
+			return false, nil
+		}
+		if !s.paused {
+			s.logf("Pausing because the pause sentinel file '%v' exists", s.PauseFile)
+			if s.OnPause != nil {
+				if err := s.OnPause(); err != nil {
+					return false, err
+				}
+			}
+			s.paused = true
+		}
+
+		select {
+		case <-s.Done:
+			return false, nil
+		default:
+		}
+		sleep(s.Interval)
+	}
+}
+
+// Stopped returns true if the stop sentinel exists, without pausing
+func (s *Sentinel) Stopped() (bool, error) {
+	return exists(s.StopFile)
+}
+
+// Create creates a sentinel file, it fails if the file already exists
+func Create(file string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("Sentinel file already exists: '%v'", file)
+		}
+		return err
+	}
+	_, err = f.WriteString(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Remove removes a sentinel file, it fails if the file doesn't exist
+func Remove(file string) error {
+	err := os.Remove(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Sentinel file doesn't exist: '%v'", file)
+	}
+	return err
+}
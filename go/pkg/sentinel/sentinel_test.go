@@ -0,0 +1,128 @@
+package sentinel
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWait(t *testing.T) {
+	dir := t.TempDir()
+	stopFile := filepath.Join(dir, "stop")
+	pauseFile := filepath.Join(dir, "pause")
+	{
+		// No sentinel file
+		s := Sentinel{StopFile: stopFile, PauseFile: pauseFile}
+		stop, err := s.Wait()
+		if stop || err != nil {
+			t.Errorf("No sentinel: expected to run, got stop: %v, err: %v", stop, err)
+		}
+	}
+	{
+		// Disabled sentinels
+		s := Sentinel{}
+		stop, err := s.Wait()
+		if stop || err != nil {
+			t.Errorf("Disabled sentinels: expected to run, got stop: %v, err: %v", stop, err)
+		}
+	}
+	{
+		// Stop sentinel
+		if err := Create(stopFile); err != nil {
+			t.Fatalf("Create(%v) returned an error: %v", stopFile, err)
+		}
+		s := Sentinel{StopFile: stopFile, PauseFile: pauseFile}
+		stop, err := s.Wait()
+		if !stop || err != nil {
+			t.Errorf("Stop sentinel: expected to stop, got stop: %v, err: %v", stop, err)
+		}
+		if err := Remove(stopFile); err != nil {
+			t.Errorf("Remove(%v) returned an error: %v", stopFile, err)
+		}
+	}
+	{
+		// Paused for 3 checks, then resumed
+		var log bytes.Buffer
+		Create(pauseFile)
+		slept := 0
+		paused := 0
+		s := Sentinel{StopFile: stopFile, PauseFile: pauseFile, Interval: time.Second, Log: &log,
+			OnPause: func() error { paused++; return nil },
+			Sleep: func(d time.Duration) {
+				slept++
+				if slept == 3 {
+					os.Remove(pauseFile)
+				}
+			},
+		}
+		stop, err := s.Wait()
+		if stop || err != nil || slept != 3 {
+			t.Errorf("Pause sentinel: expected 3 sleeps, got %d, stop: %v, err: %v", slept, stop, err)
+		}
+		if !strings.Contains(log.String(), "Pausing") || !strings.Contains(log.String(), "Resuming") {
+			t.Errorf("Pause sentinel: transitions not logged: %q", log.String())
+		}
+		if paused != 1 {
+			t.Errorf("Pause sentinel: expected OnPause to be called once, got %d", paused)
+		}
+	}
+	{
+		// Stop sentinel created while paused
+		Create(pauseFile)
+		s := Sentinel{StopFile: stopFile, PauseFile: pauseFile,
+			Sleep: func(d time.Duration) { Create(stopFile) },
+		}
+		stop, err := s.Wait()
+		if !stop || err != nil {
+			t.Errorf("Stop while paused: expected to stop, got stop: %v, err: %v", stop, err)
+		}
+		os.Remove(pauseFile)
+		os.Remove(stopFile)
+	}
+	{
+		// Done closed while paused
+		Create(pauseFile)
+		done := make(chan struct{})
+		close(done)
+		s := Sentinel{PauseFile: pauseFile, Done: done,
+			Sleep: func(d time.Duration) { t.Errorf("Unexpected sleep after done") },
+		}
+		stop, err := s.Wait()
+		if stop || err != nil {
+			t.Errorf("Done while paused: expected to return, got stop: %v, err: %v", stop, err)
+		}
+		os.Remove(pauseFile)
+	}
+}
+
+func TestStopped(t *testing.T) {
+	stopFile := filepath.Join(t.TempDir(), "stop")
+	// The pause sentinel is ignored
+	s := Sentinel{StopFile: stopFile, PauseFile: stopFile + ".missing"}
+	if stop, err := s.Stopped(); stop || err != nil {
+		t.Errorf("No stop sentinel: expected false, got %v, err: %v", stop, err)
+	}
+	Create(stopFile)
+	if stop, err := s.Stopped(); !stop || err != nil {
+		t.Errorf("Stop sentinel: expected true, got %v, err: %v", stop, err)
+	}
+}
+
+func TestCreateRemove(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sentinel")
+	if err := Create(file); err != nil {
+		t.Errorf("Create(%v) returned an error: %v", file, err)
+	}
+	if err := Create(file); err == nil {
+		t.Errorf("Create(%v) of an existing file didn't return an error", file)
+	}
+	if err := Remove(file); err != nil {
+		t.Errorf("Remove(%v) returned an error: %v", file, err)
+	}
+	if err := Remove(file); err == nil {
+		t.Errorf("Remove(%v) of a missing file didn't return an error", file)
+	}
+}
@@ -296,6 +296,7 @@ func GenerateDelStmt(tbl tableparser.TableInfo, cols []string, index string) (De
 
 // GenerateInsStmt maps SELECT columns to INSERT columns.
 // Returns the intersection of selCols and insTbl's columns, preserving selCols order.
+// The generated columns of insTbl are skipped, they can't be inserted.
 func GenerateInsStmt(insTbl tableparser.TableInfo, selCols []string) (InsStmt, error) {
 	if len(selCols) == 0 {
 		return InsStmt{}, fmt.Errorf("no SELECT columns specified")
@@ -306,7 +307,7 @@ func GenerateInsStmt(insTbl tableparser.TableInfo, selCols []string) (InsStmt, e
 		Slice: []int{},
 	}
 	for i, col := range selCols {
-		if insTbl.ColExists(col) {
+		if insTbl.ColExists(col) && !insTbl.ColIsGenerated(col) {
 			result.Cols = append(result.Cols, col)
 			result.Slice = append(result.Slice, i)
 		}
@@ -602,6 +602,27 @@ func TestGenerateInsStmt(t *testing.T) {
 			t.Errorf("insert with different col order and missing col\ngot:  %+v\nwant: %+v", got, want)
 		}
 	}
+
+	// Generated column on the insert table is skipped
+	{
+		selTbl := mustParse(t, issue131Sel)
+		insTbl := mustParse(t, "CREATE TABLE `issue_131_ins` (\n"+
+			"  `id` int NOT NULL,\n"+
+			"  `name` varchar(255) GENERATED ALWAYS AS (concat(`id`,'')) VIRTUAL,\n"+
+			"  PRIMARY KEY (`id`)\n"+
+			") ENGINE=InnoDB DEFAULT CHARSET=latin1\n")
+		got, err := GenerateInsStmt(insTbl, selTbl.GetCols())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := InsStmt{
+			Cols:  []string{"id"},
+			Slice: []int{0},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("insert with a generated col\ngot:  %+v\nwant: %+v", got, want)
+		}
+	}
 }
 
 func TestGenerateCmpWhere(t *testing.T) {
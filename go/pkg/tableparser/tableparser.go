@@ -57,6 +57,7 @@ type FkInfo struct {
     parenttb       string
     parentcolnames string
     parentcols     []string
+    onDelete       string
     fkddl          string
 }
 
@@ -448,6 +449,10 @@ func GetFks(ddl string) map[string]FkInfo {
         fki.parenttb = fkddl[3]
         fki.parentcolnames = fkddl[4]
         fki.parentcols = strings.Split(fkddl[4], ",")
+        fki.onDelete = "NO ACTION"
+        if rule := reOnDelete.FindStringSubmatch(fkddl[0]); rule != nil {
+            fki.onDelete = rule[1]
+        }
         fki.fkddl = fkddl[0]
 
         fkmap[fki.name] = *fki
@@ -456,8 +461,64 @@ func GetFks(ddl string) map[string]FkInfo {
     return fkmap
 }
 
+// Column attributes matched in the column definitions
+var (
+    reDefault  = regexp.MustCompile(`(?i)\sDEFAULT\s`)
+    reUnsigned = regexp.MustCompile(`(?i)\sUNSIGNED\b`)
+)
+
+// ON DELETE rule of a foreign key, omitted by SHOW CREATE TABLE when it is
+// the default
+var reOnDelete = regexp.MustCompile(`ON DELETE (RESTRICT|CASCADE|SET NULL|SET DEFAULT|NO ACTION)`)
+
+// unbacktickCols returns the names of backticked columns like "`a`,`b`"
+func unbacktickCols(cols []string) []string {
+    names := make([]string, len(cols))
+    for i, col := range cols {
+        names[i] = unbacktick(col)
+    }
+    return names
+}
+
+// unbacktick removes the backticks around a name
+func unbacktick(name string) string {
+    name = strings.TrimLeft(strings.TrimRight(strings.TrimSpace(name), "`"), "`")
+    return strings.ReplaceAll(name, "``", "`")
+}
+
+// Name returns the name of the foreign key constraint.
+func (fk FkInfo) Name() string {
+    return unbacktick(fk.name)
+}
+
+// Cols returns the columns of the child table, in constraint order.
+func (fk FkInfo) Cols() []string {
+    return unbacktickCols(fk.cols)
+}
+
+// ParentTable returns the database and the name of the referenced table,
+// db when the constraint doesn't name the database.
+func (fk FkInfo) ParentTable(db string) (string, string) {
+    return quoter.Splitunbacktick(fk.parenttb, db)
+}
+
+// ParentCols returns the referenced columns, matching the order of Cols.
+func (fk FkInfo) ParentCols() []string {
+    return unbacktickCols(fk.parentcols)
+}
+
+// OnDelete returns the ON DELETE rule, NO ACTION when not specified.
+func (fk FkInfo) OnDelete() string {
+    return fk.onDelete
+}
+
 //ignoring func remove_auto_increment has it doesn't seem to be used
 
+// GetEngine returns the storage engine of the table.
+func (tbl TableInfo) GetEngine() string {
+    return tbl.engine
+}
+
 // GetCols returns column names in table definition order (sorted by ColInfo.pos).
 func (tbl TableInfo) GetCols() []string {
     cols := make([]string, len(tbl.cols))
@@ -475,6 +536,38 @@ func (tbl TableInfo) ColNullable(col string) bool {
     return false
 }
 
+// ColIsAutoinc returns whether the named column is AUTO_INCREMENT.
+func (tbl TableInfo) ColIsAutoinc(col string) bool {
+    if ci, ok := tbl.cols[col]; ok {
+        return ci.autoinc
+    }
+    return false
+}
+
+// ColIsGenerated returns whether the named column is a generated column.
+func (tbl TableInfo) ColIsGenerated(col string) bool {
+    if ci, ok := tbl.cols[col]; ok {
+        return ci.generated
+    }
+    return false
+}
+
+// ColHasDefault returns whether the named column has a DEFAULT clause.
+func (tbl TableInfo) ColHasDefault(col string) bool {
+    if ci, ok := tbl.cols[col]; ok {
+        return reDefault.MatchString(ci.definition)
+    }
+    return false
+}
+
+// ColIsUnsigned returns whether the named numeric column is UNSIGNED.
+func (tbl TableInfo) ColIsUnsigned(col string) bool {
+    if ci, ok := tbl.cols[col]; ok {
+        return ci.numeric && reUnsigned.MatchString(ci.definition)
+    }
+    return false
+}
+
 // ColType returns the MySQL data type string of the named column (e.g. "enum", "int").
 func (tbl TableInfo) ColType(col string) string {
     if ci, ok := tbl.cols[col]; ok {
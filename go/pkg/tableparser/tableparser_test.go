@@ -1,6 +1,7 @@
 package tableparser
 
 import (
+	"slices"
 	"testing"
 )
 
@@ -25,6 +26,17 @@ const fkTable = "CREATE TABLE `child` (\n" +
 	"  CONSTRAINT `child_ibfk_1` FOREIGN KEY (`parent_id`) REFERENCES `parent` (`id`) ON DELETE CASCADE\n" +
 	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci\n"
 
+// fkMultiTable has a two-column foreign key to a table of another database,
+// with the default ON DELETE rule.
+const fkMultiTable = "CREATE TABLE `line` (\n" +
+	"  `id` int NOT NULL,\n" +
+	"  `order_id` int NOT NULL,\n" +
+	"  `shop_id` int NOT NULL,\n" +
+	"  PRIMARY KEY (`id`),\n" +
+	"  KEY `order_idx` (`shop_id`,`order_id`),\n" +
+	"  CONSTRAINT `line_order` FOREIGN KEY (`shop_id`,`order_id`) REFERENCES `sales`.`orders` (`shop_id`,`id`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci\n"
+
 // fullTextTable has FULLTEXT and SPATIAL keys.
 const fullTextTable = "CREATE TABLE `articles` (\n" +
 	"  `id` int NOT NULL AUTO_INCREMENT,\n" +
@@ -48,6 +60,15 @@ const prefixTable = "CREATE TABLE `docs` (\n" +
 	"  KEY `content_pfx` (`content`(100))\n" +
 	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci\n"
 
+// generatedTable has a generated column and a column with a default.
+const generatedTable = "CREATE TABLE `orders` (\n" +
+	"  `id` bigint unsigned NOT NULL,\n" +
+	"  `qty` int NOT NULL DEFAULT '1',\n" +
+	"  `price` decimal(10,2) NOT NULL,\n" +
+	"  `total` decimal(12,2) GENERATED ALWAYS AS ((`qty` * `price`)) STORED NOT NULL,\n" +
+	"  PRIMARY KEY (`id`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci\n"
+
 func TestGetengine(t *testing.T) {
 	{
 		// InnoDB extracted from simpleTable
@@ -76,6 +97,27 @@ func TestGetengine(t *testing.T) {
 			t.Errorf("Getengine expected error for missing ENGINE, got nil")
 		}
 	}
+	{
+		// GetEngine returns the engine extracted by Parse
+		for _, c := range []struct {
+			ddl    string
+			engine string
+		}{
+			{simpleTable, "InnoDB"},
+			{noPKTable, "MyISAM"},
+		} {
+			ti, err := Parse(c.ddl)
+			if err != nil {
+				t.Fatalf("Parse returned unexpected error: %v", err)
+			}
+			if ti.GetEngine() != c.engine {
+				t.Errorf("GetEngine expected '%v', got '%v'", c.engine, ti.GetEngine())
+			}
+		}
+		if eng := (TableInfo{}).GetEngine(); eng != "" {
+			t.Errorf("GetEngine of an empty TableInfo expected '', got '%v'", eng)
+		}
+	}
 }
 
 func TestGetcharset(t *testing.T) {
@@ -224,6 +266,31 @@ func TestGetFks(t *testing.T) {
 		if fk.parenttb != "`parent`" {
 			t.Errorf("GetFks: expected parenttb '`parent`', got '%v'", fk.parenttb)
 		}
+		if fk.Name() != "child_ibfk_1" {
+			t.Errorf("Name: expected 'child_ibfk_1', got '%v'", fk.Name())
+		}
+		if db, tbl := fk.ParentTable("test"); db != "test" || tbl != "parent" {
+			t.Errorf("ParentTable: expected test.parent, got %v.%v", db, tbl)
+		}
+		if fk.OnDelete() != "CASCADE" {
+			t.Errorf("OnDelete: expected 'CASCADE', got '%v'", fk.OnDelete())
+		}
+	}
+	{
+		// fkMultiTable: two columns, parent in another database, default rule
+		fk := GetFks(fkMultiTable)["`line_order`"]
+		if !slices.Equal(fk.Cols(), []string{"shop_id", "order_id"}) {
+			t.Errorf("Cols: expected [shop_id order_id], got %v", fk.Cols())
+		}
+		if !slices.Equal(fk.ParentCols(), []string{"shop_id", "id"}) {
+			t.Errorf("ParentCols: expected [shop_id id], got %v", fk.ParentCols())
+		}
+		if db, tbl := fk.ParentTable("test"); db != "sales" || tbl != "orders" {
+			t.Errorf("ParentTable: expected sales.orders, got %v.%v", db, tbl)
+		}
+		if fk.OnDelete() != "NO ACTION" {
+			t.Errorf("OnDelete: expected 'NO ACTION', got '%v'", fk.OnDelete())
+		}
 	}
 	{
 		// simpleTable has no FKs
@@ -336,6 +403,15 @@ func TestParse(t *testing.T) {
 		if !ti.cols["id"].autoinc {
 			t.Errorf("Parse: column 'id' should have autoinc=true")
 		}
+		if !ti.ColIsAutoinc("id") || ti.ColIsAutoinc("a") || ti.ColIsAutoinc("missing") {
+			t.Errorf("Parse: ColIsAutoinc should be true only for column 'id'")
+		}
+		if !ti.ColIsUnsigned("id") || ti.ColIsUnsigned("score") {
+			t.Errorf("Parse: ColIsUnsigned should be true only for column 'id'")
+		}
+		if !ti.ColHasDefault("score") || ti.ColHasDefault("a") {
+			t.Errorf("Parse: ColHasDefault should be true for 'score' and false for 'a'")
+		}
 		if ti.cols["id"].nullable {
 			t.Errorf("Parse: column 'id' should have nullable=false")
 		}
@@ -359,6 +435,22 @@ func TestParse(t *testing.T) {
 			t.Errorf("Parse: expected 'a_unique' key")
 		}
 	}
+	{
+		// Generated column and defaults
+		ti, err := Parse(generatedTable)
+		if err != nil {
+			t.Fatalf("Parse returned unexpected error: %v", err)
+		}
+		if !ti.ColIsGenerated("total") || ti.ColIsGenerated("price") {
+			t.Errorf("Parse: ColIsGenerated should be true only for column 'total'")
+		}
+		if !ti.ColHasDefault("qty") || ti.ColHasDefault("price") {
+			t.Errorf("Parse: ColHasDefault should be true for 'qty' and false for 'price'")
+		}
+		if !ti.ColIsUnsigned("id") || ti.ColIsUnsigned("qty") {
+			t.Errorf("Parse: ColIsUnsigned should be true only for column 'id'")
+		}
+	}
 	{
 		// Empty DDL returns error
 		_, err := Parse("")
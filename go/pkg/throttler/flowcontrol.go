@@ -0,0 +1,129 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   FlowControlWaiter waits while a Galera/PXC node spends too much time
+   paused by flow control. It is the equivalent of the Perl
+   FlowControlWaiter module.
+
+*/
+
+package throttler
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/y-trudeau/go-toolkit/go/pkg/debug"
+	"github.com/y-trudeau/go-toolkit/go/pkg/dsn"
+)
+
+// FlowControlSource returns wsrep_flow_control_paused_ns, the total time
+// in nanoseconds a node has been paused by flow control.
+type FlowControlSource interface {
+	Name() string
+	PausedNs() (uint64, error)
+}
+
+type FlowControlWaiter struct {
+	Source   FlowControlSource
+	MaxPct   float64             // maximum percentage of time paused
+	Interval time.Duration       // time to wait before sampling again
+	Sleep    func(time.Duration) // nil means sleeping until Interval elapses or done is closed
+	Now      func() time.Time    // nil means time.Now
+	lastNs   uint64
+	lastTime time.Time
+}
+
+// sample returns the percentage of time paused since the previous sample,
+// the first sample has nothing to compare to and returns 0.
+func (w *FlowControlWaiter) sample() (float64, error) {
+	paused, err := w.Source.PausedNs()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to get the flow control of %v: %v", w.Source.Name(), err)
+	}
+	now := time.Now()
+	if w.Now != nil {
+		now = w.Now()
+	}
+
+	pct := 0.0
+	elapsed := now.Sub(w.lastTime)
+	// The counter is reset when the node restarts
+	if !w.lastTime.IsZero() && elapsed > 0 && paused >= w.lastNs {
+		pct = float64(paused-w.lastNs) / float64(elapsed.Nanoseconds()) * 100
+	}
+	w.lastNs = paused
+	w.lastTime = now
+	return pct, nil
+}
+
+// Wait blocks while the node was paused by flow control more than MaxPct
+// percent of the time since the last sample, or until done is closed.
+func (w *FlowControlWaiter) Wait(done <-chan struct{}) error {
+	for !closed(done) {
+		pct, err := w.sample()
+		if err != nil {
+			return err
+		}
+		if pct <= w.MaxPct {
+			return nil
+		}
+		debug.Print(fmt.Sprintf("Waiting for flow control: %v paused %.2f%% of the time", w.Source.Name(), pct))
+		if pause(w.Sleep, w.Interval, done) {
+			debug.Print("Stopped while waiting for flow control")
+		}
+	}
+	return nil
+}
+
+// GaleraFlowControl reads wsrep_flow_control_paused_ns from a node
+type GaleraFlowControl struct {
+	Node dsn.Dsn
+}
+
+// NewGaleraFlowControl parses the DSN of the node, it uses its own
+// connection to be sampled while the tool is in a transaction.
+func NewGaleraFlowControl(dsnValue string) (*GaleraFlowControl, error) {
+	g := &GaleraFlowControl{}
+	if err := g.Node.Parse(dsnValue); err != nil {
+		return nil, fmt.Errorf("Invalid node DSN '%v': %v", dsnValue, err)
+	}
+	return g, nil
+}
+
+// Name returns the host, or socket, of the node
+func (g *GaleraFlowControl) Name() string {
+	if len(g.Node.Socket) > 0 {
+		return g.Node.Socket
+	}
+	return fmt.Sprintf("%v:%d", g.Node.Host, g.Node.Port)
+}
+
+// PausedNs returns the wsrep_flow_control_paused_ns status counter
+func (g *GaleraFlowControl) PausedNs() (uint64, error) {
+	dbh, err := g.Node.Getconn()
+	if err != nil {
+		return 0, err
+	}
+	var name string
+	var paused uint64
+	err = dbh.QueryRow("SHOW GLOBAL STATUS LIKE 'wsrep_flow_control_paused_ns'").Scan(&name, &paused)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%v is not a Galera node", g.Name())
+	}
+	return paused, err
+}
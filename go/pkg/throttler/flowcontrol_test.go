@@ -0,0 +1,100 @@
+package throttler
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeFlowControl returns the counters in sequence, the last one is repeated
+type fakeFlowControl struct {
+	paused []uint64
+	calls  int
+}
+
+func (f *fakeFlowControl) Name() string {
+	return "node1"
+}
+
+func (f *fakeFlowControl) PausedNs() (uint64, error) {
+	if len(f.paused) == 0 {
+		return 0, errors.New("broken")
+	}
+	i := f.calls
+	if i >= len(f.paused) {
+		i = len(f.paused) - 1
+	}
+	f.calls++
+	return f.paused[i], nil
+}
+
+func TestFlowControlWaiter(t *testing.T) {
+	{
+		// One second between samples, paused 50% then 20% then 0.5%
+		now := time.Unix(1000, 0)
+		slept := 0
+		w := FlowControlWaiter{
+			Source: &fakeFlowControl{paused: []uint64{0, 500e6, 700e6, 705e6}},
+			MaxPct: 1,
+			Now: func() time.Time {
+				now = now.Add(time.Second)
+				return now
+			},
+			Sleep: func(time.Duration) { slept++ },
+		}
+		// First sample has nothing to compare to
+		if err := w.Wait(nil); err != nil || slept != 0 {
+			t.Errorf("First sample: expected no sleep, got %d, err: %v", slept, err)
+		}
+		if err := w.Wait(nil); err != nil || slept != 2 {
+			t.Errorf("Flow control: expected 2 sleeps, got %d, err: %v", slept, err)
+		}
+	}
+	{
+		// Counter reset by a restart
+		now := time.Unix(1000, 0)
+		w := FlowControlWaiter{
+			Source: &fakeFlowControl{paused: []uint64{900e6, 0}},
+			MaxPct: 1,
+			Now: func() time.Time {
+				now = now.Add(time.Second)
+				return now
+			},
+			Sleep: func(time.Duration) { t.Errorf("Unexpected sleep after a counter reset") },
+		}
+		w.Wait(nil)
+		if err := w.Wait(nil); err != nil {
+			t.Errorf("Counter reset returned an error: %v", err)
+		}
+	}
+	{
+		// Paused all the time, closing done stops the wait
+		now := time.Unix(1000, 0)
+		slept := 0
+		done := make(chan struct{})
+		w := FlowControlWaiter{
+			Source: &fakeFlowControl{paused: []uint64{0, 1e9, 2e9, 3e9}},
+			MaxPct: 1,
+			Now: func() time.Time {
+				now = now.Add(time.Second)
+				return now
+			},
+			Sleep: func(time.Duration) {
+				if slept++; slept == 2 {
+					close(done)
+				}
+			},
+		}
+		w.Wait(nil)
+		if err := w.Wait(done); err != nil || slept != 2 {
+			t.Errorf("Stopped: expected 2 sleeps, got %d, err: %v", slept, err)
+		}
+	}
+	{
+		// Errors are returned
+		w := FlowControlWaiter{Source: &fakeFlowControl{}}
+		if err := w.Wait(nil); err == nil {
+			t.Errorf("Error from the flow control source not returned")
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   ReplicaLagWaiter waits until all the replicas are lagging less than a
+   maximum. It is the equivalent of the Perl ReplicaLagWaiter module.
+
+*/
+
+package throttler
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/y-trudeau/go-toolkit/go/pkg/debug"
+	"github.com/y-trudeau/go-toolkit/go/pkg/dsn"
+
+	"go-toolkit/pkg/version"
+)
+
+// LagSource returns the replication lag of a replica
+type LagSource interface {
+	Name() string
+	// Lag returns the lag in seconds, NULL when replication is not running
+	Lag() (sql.NullInt64, error)
+}
+
+type ReplicaLagWaiter struct {
+	Sources  []LagSource
+	MaxLag   time.Duration
+	Interval time.Duration       // time to wait before checking again
+	Sleep    func(time.Duration) // nil means sleeping until Interval elapses or done is closed
+}
+
+// Wait blocks until every replica lags less than or equal to MaxLag, or
+// until done is closed. A replica with replication stopped is considered
+// lagging.
+func (w *ReplicaLagWaiter) Wait(done <-chan struct{}) error {
+	for !closed(done) {
+		lagging := ""
+		for _, src := range w.Sources {
+			lag, err := src.Lag()
+			if err != nil {
+				return fmt.Errorf("Unable to get the lag of replica %v: %v", src.Name(), err)
+			}
+			if !lag.Valid {
+				lagging = src.Name() + " is not replicating"
+				break
+			}
+			if time.Duration(lag.Int64)*time.Second > w.MaxLag {
+				lagging = fmt.Sprintf("%v is lagging by %ds", src.Name(), lag.Int64)
+				break
+			}
+		}
+		if len(lagging) == 0 {
+			return nil
+		}
+		debug.Print("Waiting for replica lag: " + lagging)
+		if pause(w.Sleep, w.Interval, done) {
+			debug.Print("Stopped while waiting for replica lag")
+		}
+	}
+	return nil
+}
+
+// ReplicaLag reads the lag of a replica from SHOW REPLICA STATUS or, for
+// older versions, SHOW SLAVE STATUS.
+type ReplicaLag struct {
+	Replica dsn.Dsn
+	Channel string
+	query   string
+}
+
+// NewReplicaLag parses a replica DSN, user and password override the DSN
+// values when not empty.
+func NewReplicaLag(dsnValue string, channel string, user string, password string) (*ReplicaLag, error) {
+	r := &ReplicaLag{Channel: channel}
+	if err := r.Replica.Parse(dsnValue); err != nil {
+		return nil, fmt.Errorf("Invalid replica DSN '%v': %v", dsnValue, err)
+	}
+	if len(user) > 0 {
+		r.Replica.User = user
+	}
+	if len(password) > 0 {
+		r.Replica.Password = password
+	}
+	return r, nil
+}
+
+// Name returns the host, or socket, of the replica
+func (r *ReplicaLag) Name() string {
+	if len(r.Replica.Socket) > 0 {
+		return r.Replica.Socket
+	}
+	return fmt.Sprintf("%v:%d", r.Replica.Host, r.Replica.Port)
+}
+
+// StatusQuery returns the replica status statement for a server version.
+// SHOW REPLICA STATUS appeared in 8.0.22, unknown versions are assumed newer.
+func StatusQuery(serverVersion string) string {
+	if c, err := version.Compare(serverVersion, "8.0.22"); err == nil && c < 0 {
+		return "SHOW SLAVE STATUS"
+	}
+	return "SHOW REPLICA STATUS"
+}
+
+// Lag returns Seconds_Behind_Source, or Seconds_Behind_Master, of the
+// replica for the configured channel.
+func (r *ReplicaLag) Lag() (sql.NullInt64, error) {
+	var lag sql.NullInt64
+	dbh, err := r.Replica.Getconn()
+	if err != nil {
+		return lag, err
+	}
+
+	if len(r.query) == 0 {
+		var v string
+		if err := dbh.QueryRow("SELECT @@version").Scan(&v); err != nil {
+			return lag, err
+		}
+		r.query = StatusQuery(v)
+		if len(r.Channel) > 0 {
+			r.query = r.query + " FOR CHANNEL '" + strings.ReplaceAll(r.Channel, "'", "''") + "'"
+		}
+		debug.Printvar("Replica status query", r.query)
+	}
+
+	rows, err := dbh.Query(r.query)
+	if err != nil {
+		return lag, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return lag, err
+	}
+	lagCol := -1
+	for i, col := range cols {
+		if col == "Seconds_Behind_Source" || col == "Seconds_Behind_Master" {
+			lagCol = i
+		}
+	}
+	if lagCol < 0 {
+		return lag, fmt.Errorf("No Seconds_Behind_Source column in the output of %v", r.query)
+	}
+
+	found := 0
+	for rows.Next() {
+		values := make([]sql.NullString, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return lag, err
+		}
+		found++
+		if values[lagCol].Valid {
+			if _, err := fmt.Sscan(values[lagCol].String, &lag.Int64); err != nil {
+				return lag, err
+			}
+			lag.Valid = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return lag, err
+	}
+	switch {
+	case found == 0:
+		return lag, fmt.Errorf("%v is not a replica", r.Name())
+	case found > 1:
+		return lag, fmt.Errorf("%v has multiple replication channels, a channel must be specified", r.Name())
+	}
+	return lag, nil
+}
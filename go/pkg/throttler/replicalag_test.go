@@ -0,0 +1,143 @@
+package throttler
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeLag returns the lags in sequence, the last one is repeated
+type fakeLag struct {
+	name  string
+	lags  []sql.NullInt64
+	calls int
+}
+
+func (f *fakeLag) Name() string {
+	return f.name
+}
+
+func (f *fakeLag) Lag() (sql.NullInt64, error) {
+	i := f.calls
+	if i >= len(f.lags) {
+		i = len(f.lags) - 1
+	}
+	f.calls++
+	if i < 0 {
+		return sql.NullInt64{}, errors.New("broken")
+	}
+	return f.lags[i], nil
+}
+
+func lag(s int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: s, Valid: true}
+}
+
+func TestReplicaLagWaiter(t *testing.T) {
+	{
+		// No lag, no wait
+		slept := 0
+		w := ReplicaLagWaiter{
+			Sources:  []LagSource{&fakeLag{name: "r1", lags: []sql.NullInt64{lag(0)}}},
+			MaxLag:   time.Second,
+			Interval: time.Second,
+			Sleep:    func(time.Duration) { slept++ },
+		}
+		if err := w.Wait(nil); err != nil || slept != 0 {
+			t.Errorf("No lag: expected no sleep, got %d sleeps, err: %v", slept, err)
+		}
+	}
+	{
+		// Second replica lagging then stopped, then caught up
+		slept := 0
+		r1 := &fakeLag{name: "r1", lags: []sql.NullInt64{lag(1)}}
+		r2 := &fakeLag{name: "r2", lags: []sql.NullInt64{lag(5), {}, lag(1)}}
+		w := ReplicaLagWaiter{
+			Sources:  []LagSource{r1, r2},
+			MaxLag:   time.Second,
+			Interval: 2 * time.Second,
+			Sleep: func(d time.Duration) {
+				if d != 2*time.Second {
+					t.Errorf("Expected sleeps of 2s, got %v", d)
+				}
+				slept++
+			},
+		}
+		if err := w.Wait(nil); err != nil || slept != 2 {
+			t.Errorf("Lagging replica: expected 2 sleeps, got %d, err: %v", slept, err)
+		}
+	}
+	{
+		// A stopped replica lags forever, closing done stops the wait
+		slept := 0
+		done := make(chan struct{})
+		w := ReplicaLagWaiter{
+			Sources: []LagSource{&fakeLag{name: "r1", lags: []sql.NullInt64{{}}}},
+			MaxLag:  time.Second,
+			Sleep: func(time.Duration) {
+				if slept++; slept == 3 {
+					close(done)
+				}
+			},
+		}
+		if err := w.Wait(done); err != nil || slept != 3 {
+			t.Errorf("Stopped replica: expected 3 sleeps, got %d, err: %v", slept, err)
+		}
+		// Once done is closed the replicas are not checked anymore
+		r1 := &fakeLag{name: "r1"}
+		w = ReplicaLagWaiter{Sources: []LagSource{r1}}
+		if err := w.Wait(done); err != nil || r1.calls != 0 {
+			t.Errorf("Closed done: expected no lag check, got %d, err: %v", r1.calls, err)
+		}
+	}
+	{
+		// The default sleep is interrupted by done
+		done := make(chan struct{})
+		w := ReplicaLagWaiter{
+			Sources:  []LagSource{&fakeLag{name: "r1", lags: []sql.NullInt64{{}}}},
+			MaxLag:   time.Second,
+			Interval: time.Hour,
+		}
+		time.AfterFunc(10*time.Millisecond, func() { close(done) })
+		start := time.Now()
+		if err := w.Wait(done); err != nil || time.Since(start) > time.Minute {
+			t.Errorf("Interrupted sleep: waited %v, err: %v", time.Since(start), err)
+		}
+	}
+	{
+		// Errors are returned
+		w := ReplicaLagWaiter{Sources: []LagSource{&fakeLag{name: "r1"}}}
+		if err := w.Wait(nil); err == nil {
+			t.Errorf("Error from the lag source not returned")
+		}
+	}
+}
+
+func TestStatusQuery(t *testing.T) {
+	tests := map[string]string{
+		"5.7.44":    "SHOW SLAVE STATUS",
+		"8.0.21-12": "SHOW SLAVE STATUS",
+		"8.0.22":    "SHOW REPLICA STATUS",
+		"8.4.3":     "SHOW REPLICA STATUS",
+		"9.1.0":     "SHOW REPLICA STATUS",
+	}
+	for v, e := range tests {
+		if r := StatusQuery(v); r != e {
+			t.Errorf("StatusQuery(%v): expected '%v', got '%v'", v, e, r)
+		}
+	}
+}
+
+func TestNewReplicaLag(t *testing.T) {
+	r, err := NewReplicaLag("h=replica1,P=3307,u=bob,p=secret", "ch1", "repl", "")
+	if err != nil {
+		t.Fatalf("NewReplicaLag returned an error: %v", err)
+	}
+	if r.Replica.User != "repl" || r.Replica.Password != "secret" || r.Channel != "ch1" {
+		t.Errorf("Slave user override failed, got user '%v', password '%v'", r.Replica.User, r.Replica.Password)
+	}
+	if r.Name() != "replica1:3307" {
+		t.Errorf("Name: expected 'replica1:3307', got '%v'", r.Name())
+	}
+}
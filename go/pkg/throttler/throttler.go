@@ -0,0 +1,67 @@
+/*
+   Copyright 2023, Yves Trudeau, Percona Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+   This package throttles tools like pt-archiver when the servers around
+   them are getting behind, like replicas lagging.
+
+*/
+
+package throttler
+
+import (
+	"time"
+)
+
+// Throttler is a source of throttling checked by a tool between chunks
+type Throttler interface {
+	// Wait blocks until the throttled resource is back under its threshold
+	// or until done is closed, the tool stopping.
+	Wait(done <-chan struct{}) error
+}
+
+// WaitAll calls Wait on all the throttlers, in order
+func WaitAll(throttlers []Throttler, done <-chan struct{}) error {
+	for _, t := range throttlers {
+		if err := t.Wait(done); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closed returns true once done is closed
+func closed(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// pause waits for d, with sleep when replaced by the tests, and returns true
+// if done was closed meanwhile.
+func pause(sleep func(time.Duration), d time.Duration, done <-chan struct{}) bool {
+	if sleep != nil {
+		sleep(d)
+	} else {
+		select {
+		case <-time.After(d):
+		case <-done:
+		}
+	}
+	return closed(done)
+}